@@ -0,0 +1,53 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"os"
+
+	"github.com/vvityuk/shortener/internal/app"
+	"github.com/vvityuk/shortener/internal/config"
+	"github.com/vvityuk/shortener/internal/export"
+	"go.uber.org/zap"
+)
+
+// runExport выгружает все ссылки хранилища из конфигурации в stdout или файл.
+func runExport(cfg *config.Config, logger *zap.Logger, args []string) error {
+	fs := flag.NewFlagSet("export", flag.ContinueOnError)
+	format := fs.String("format", export.FormatNDJSON, "export format: csv or ndjson")
+	output := fs.String("output", "", "output file, stdout by default")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	out := os.Stdout
+	if *output != "" {
+		f, err := os.Create(*output)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		out = f
+	}
+	w, err := export.NewWriter(out, *format)
+	if err != nil {
+		return err
+	}
+
+	store, err := app.OpenStorage(cfg, logger)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+
+	if err := store.ForEach(context.Background(), w.Write); err != nil {
+		return err
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	if out != os.Stdout {
+		return out.Close()
+	}
+	return nil
+}
@@ -1,13 +1,23 @@
 package main
 
 import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"flag"
+	"fmt"
 	"log"
 	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	"github.com/go-chi/chi/v5"
 	"github.com/vvityuk/shortener/internal/app"
 	"github.com/vvityuk/shortener/internal/app/middleware"
 	"github.com/vvityuk/shortener/internal/config"
+	"github.com/vvityuk/shortener/internal/health"
 	"go.uber.org/zap"
 )
 
@@ -21,31 +31,129 @@ func main() {
 
 	cfg, err := config.NewConfig()
 	if err != nil {
-		panic("Failed to initialize config")
+		logger.Fatal("failed to initialize config", zap.Error(err))
 	}
+
+	// Подкоманды: shortener [flags] <command> [args]
+	if args := flag.Args(); len(args) > 0 {
+		if err := runCommand(cfg, logger, args); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+
 	// Инициализация сервиса и обработчиков
-	service, err := app.NewService(cfg)
+	service, err := app.NewService(cfg, logger)
 	if err != nil {
-		panic("Failed to initialize service")
+		logger.Fatal("failed to initialize service", zap.Error(err))
 	}
-	defer service.Close()
 
 	handler := app.NewHandler(service)
 
+	authSecret := []byte(cfg.AuthSecret)
+	if len(authSecret) == 0 {
+		// Без постоянного ключа cookie пользователей не переживут перезапуск
+		authSecret = make([]byte, 32)
+		if _, err := rand.Read(authSecret); err != nil {
+			panic("Failed to generate auth secret")
+		}
+		logger.Warn("auth secret is not configured, using a random one")
+	}
+
 	r := chi.NewRouter()
+	r.Use(middleware.Metrics(service.Metrics()))
 	r.Use(middleware.LoggingMiddleware(logger))
 	r.Use(middleware.CompressResponse)
-	r.Use(middleware.DecompressRequest)
+	r.Use(middleware.Auth(authSecret))
 	// Роуты
-	r.Get("/{shortCode}", handler.GetURL)
-	r.Post("/", handler.CreateURL)
-	r.Post("/api/shorten", handler.ShortenURL)
-	r.Get("/ping", handler.PingDB)
-	r.Post("/api/shorten/batch", handler.BatchShortenURL)
+	r.Group(func(r chi.Router) {
+		r.Use(middleware.DecompressRequest(middleware.BodyLimits{
+			MaxSize:             cfg.MaxBodySize,
+			MaxDecompressedSize: cfg.MaxDecompressedBodySize,
+		}))
+		r.Get("/{shortCode}", handler.GetURL)
+		r.Post("/", handler.CreateURL)
+		r.Post("/api/shorten", handler.ShortenURL)
+		r.Get("/ping", handler.PingDB)
+		r.Get("/metrics", service.Metrics().ServeHTTP)
+		r.Get("/healthz", health.Live)
+		r.Get("/readyz", service.Readiness().ServeHTTP)
+		r.Post("/api/shorten/batch", handler.BatchShortenURL)
+		r.Get("/api/user/urls", handler.GetUserURLs)
+		r.Get("/api/urls/{shortCode}/stats", handler.URLStats)
+		r.Delete("/api/user/urls", handler.DeleteUserURLs)
+		r.With(middleware.AdminOnly(cfg.AdminToken)).Get("/api/admin/export", handler.ExportURLs)
+	})
+	// Импорт читается построчно и не держит тело в памяти, поэтому
+	// у него свой, больший лимит
+	r.With(middleware.DecompressRequest(middleware.BodyLimits{
+		MaxSize:             cfg.StreamMaxBodySize,
+		MaxDecompressedSize: cfg.StreamMaxBodySize,
+	})).Post("/api/shorten/stream", handler.StreamShortenURL)
 
 	// Запуск сервера
-	err = http.ListenAndServe(cfg.ServerAddress, r)
-	if err != nil {
-		panic(err)
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	server := &http.Server{Addr: cfg.ServerAddress, Handler: r}
+	serverErr := make(chan error, 1)
+	go func() {
+		logger.Info("server started", zap.String("address", cfg.ServerAddress))
+		serverErr <- server.ListenAndServe()
+	}()
+
+	serverFailed := false
+	select {
+	case <-ctx.Done():
+		logger.Info("shutdown signal received, draining requests", zap.Duration("timeout", cfg.ShutdownTimeout))
+		// Проверка готовности перестаёт проходить, но запросы ещё
+		// обслуживаются, пока оркестратор не снимет трафик
+		service.Drain()
+		if cfg.DrainDelay > 0 {
+			logger.Info("waiting for traffic to drain", zap.Duration("delay", cfg.DrainDelay))
+			time.Sleep(cfg.DrainDelay)
+		}
+	case err := <-serverErr:
+		if !errors.Is(err, http.ErrServerClosed) {
+			logger.Error("server failed", zap.Error(err))
+			serverFailed = true
+		}
+	}
+
+	// Сначала перестаём принимать соединения и дожидаемся активных запросов,
+	// затем останавливаем фоновые задачи сервиса и закрываем хранилище
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), cfg.ShutdownTimeout)
+	defer cancel()
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		logger.Error("failed to drain requests", zap.Error(err))
+	} else {
+		logger.Info("requests drained")
+	}
+
+	if err := service.Close(); err != nil {
+		logger.Error("failed to close service", zap.Error(err))
+	}
+	logger.Info("shutdown complete")
+
+	// Сервер не смог работать: после очистки сообщаем об ошибке кодом
+	// возврата. os.Exit не выполняет отложенные вызовы, поэтому журнал
+	// сбрасывается явно
+	if serverFailed {
+		logger.Sync()
+		os.Exit(1)
+	}
+}
+
+func runCommand(cfg *config.Config, logger *zap.Logger, args []string) error {
+	switch args[0] {
+	case "migrate":
+		return runMigrate(cfg, args[1:])
+	case "export":
+		return runExport(cfg, logger, args[1:])
+	case "migrate-data":
+		return runMigrateData(cfg, args[1:])
+	default:
+		return fmt.Errorf("unknown command %q", args[0])
 	}
 }
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"text/tabwriter"
+	"time"
+
+	"github.com/vvityuk/shortener/internal/app"
+	"github.com/vvityuk/shortener/internal/config"
+	"github.com/vvityuk/shortener/internal/storage/postgres"
+)
+
+const migrateUsage = "usage: shortener [flags] migrate up|down [steps]|status"
+
+// runMigrate выполняет команду migrate для базы из конфигурации.
+func runMigrate(cfg *config.Config, args []string) error {
+	if len(args) == 0 {
+		return errors.New(migrateUsage)
+	}
+	if cfg.DatabaseDSN == "" {
+		return errors.New("database DSN is required: set -d or DATABASE_DSN")
+	}
+
+	db, err := postgres.Open(cfg.DatabaseDSN, app.PoolOptions(cfg))
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	ctx := context.Background()
+	switch args[0] {
+	case "up":
+		if err := postgres.MigrateUp(ctx, db); err != nil {
+			return err
+		}
+	case "down":
+		steps := 1
+		if len(args) > 1 {
+			if steps, err = strconv.Atoi(args[1]); err != nil || steps < 1 {
+				return fmt.Errorf("invalid number of steps %q", args[1])
+			}
+		}
+		if err := postgres.MigrateDown(ctx, db, steps); err != nil {
+			return err
+		}
+	case "status":
+	default:
+		return errors.New(migrateUsage)
+	}
+
+	states, err := postgres.MigrationStatus(ctx, db)
+	if err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "VERSION\tNAME\tSTATUS\tAPPLIED AT")
+	for _, st := range states {
+		status, appliedAt := "pending", ""
+		if st.Applied {
+			status, appliedAt = "applied", st.AppliedAt.Format(time.RFC3339)
+		}
+		fmt.Fprintf(w, "%04d\t%s\t%s\t%s\n", st.Version, st.Name, status, appliedAt)
+	}
+	return w.Flush()
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/vvityuk/shortener/internal/app"
+	"github.com/vvityuk/shortener/internal/config"
+)
+
+const migrateDataUsage = "usage: shortener [flags] migrate-data --from=<storage> --to=<storage> [--dry-run] [--batch-size=n] [--checkpoint=path]\n" +
+	"storage: memory:, file:<path> or postgres://..."
+
+// runMigrateData копирует все ссылки из одного хранилища в другое.
+func runMigrateData(cfg *config.Config, args []string) error {
+	fs := flag.NewFlagSet("migrate-data", flag.ContinueOnError)
+	from := fs.String("from", "", "source storage")
+	to := fs.String("to", "", "destination storage")
+	dryRun := fs.Bool("dry-run", false, "only report what would be copied")
+	batchSize := fs.Int("batch-size", 500, "links per write")
+	checkpoint := fs.String("checkpoint", "migrate-data.checkpoint", "checkpoint file to resume from, empty disables checkpoints")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *from == "" || *to == "" {
+		return errors.New(migrateDataUsage)
+	}
+	if *from == *to {
+		return errors.New("source and destination must differ")
+	}
+	// Источник открывается только для чтения: перенос, тем более пробный,
+	// не должен его менять. Отсутствующий файл при этом не создаётся
+	source, err := app.OpenStorageURIReadOnly(*from, cfg)
+	if err != nil {
+		return fmt.Errorf("failed to open source: %w", err)
+	}
+	defer source.Close()
+	destination, err := app.OpenStorageURI(*to, cfg)
+	if err != nil {
+		return fmt.Errorf("failed to open destination: %w", err)
+	}
+	defer destination.Close()
+
+	opts := app.CopyOptions{
+		BatchSize:  *batchSize,
+		DryRun:     *dryRun,
+		Checkpoint: *checkpoint,
+		// DSN может содержать пароль, поэтому в контрольную точку пишется хеш
+		CopyID: fmt.Sprintf("%x", sha256.Sum256([]byte(*from+"\x00"+*to))),
+		Progress: func(r app.CopyReport) {
+			fmt.Fprintf(os.Stderr, "read %d, copied %d, present %d, conflicts %d\n", r.Read, r.Copied, r.Present, len(r.Conflicts))
+		},
+	}
+	report, err := app.CopyURLs(context.Background(), source, destination, opts)
+	if err != nil && report.Read == 0 {
+		return err
+	}
+
+	for _, c := range report.Conflicts {
+		fmt.Printf("conflict: %s -> %s: %s\n", c.ShortURL, c.OriginalURL, c.Reason)
+	}
+	verb := "copied"
+	if *dryRun {
+		verb = "to copy"
+	}
+	fmt.Printf("read %d (resumed after %d), %s %d, already present %d, conflicts %d\n",
+		report.Read, report.Resumed, verb, report.Copied, report.Present, len(report.Conflicts))
+	if err != nil {
+		return err
+	}
+	fmt.Printf("source: %s\n", report.Source)
+	if *dryRun {
+		if len(report.Conflicts) > 0 {
+			return fmt.Errorf("%d links cannot be copied", len(report.Conflicts))
+		}
+		return nil
+	}
+	fmt.Printf("destination: %s\nverified\n", report.Destination)
+	return nil
+}
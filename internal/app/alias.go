@@ -0,0 +1,44 @@
+package app
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/vvityuk/shortener/internal/config"
+)
+
+const (
+	minAliasLength = 3
+	aliasAlphabet  = codeAlphabet + "-_"
+)
+
+// reservedAliases совпадают с путями сервиса и не могут быть короткими кодами.
+var reservedAliases = map[string]bool{
+	"api":     true,
+	"healthz": true,
+	"metrics": true,
+	"ping":    true,
+	"readyz":  true,
+}
+
+var (
+	ErrInvalidAlias = errors.New("invalid alias")
+	ErrAliasTaken   = errors.New("alias already taken")
+)
+
+// validateAlias проверяет пользовательский короткий код.
+func validateAlias(alias string) error {
+	if len(alias) < minAliasLength || len(alias) > config.MaxShortCodeLength {
+		return fmt.Errorf("%w: length must be between %d and %d", ErrInvalidAlias, minAliasLength, config.MaxShortCodeLength)
+	}
+	for _, c := range alias {
+		if !strings.ContainsRune(aliasAlphabet, c) {
+			return fmt.Errorf("%w: character %q is not allowed", ErrInvalidAlias, c)
+		}
+	}
+	if reservedAliases[strings.ToLower(alias)] {
+		return fmt.Errorf("%w: %q is reserved", ErrInvalidAlias, alias)
+	}
+	return nil
+}
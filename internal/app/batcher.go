@@ -0,0 +1,110 @@
+package app
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// ErrShuttingDown возвращается, когда сервис уже не принимает новые задачи.
+var ErrShuttingDown = errors.New("service is shutting down")
+
+// errQueueFull возвращает batcher.offer, если в очереди нет места.
+var errQueueFull = errors.New("queue is full")
+
+// batcher сводит элементы от всех обработчиков в одну очередь (fan-in)
+// и в фоне передаёт их flush пакетами: когда набралось size элементов
+// или прошёл interval. По таймеру flush вызывается и с пустым пакетом.
+type batcher[T any] struct {
+	size     int
+	interval time.Duration
+	flush    func([]T)
+
+	mu     sync.RWMutex
+	closed bool
+	queue  chan []T
+	done   chan struct{}
+}
+
+func newBatcher[T any](size int, interval time.Duration, queueSize int, flush func([]T)) *batcher[T] {
+	b := &batcher[T]{
+		size:     size,
+		interval: interval,
+		flush:    flush,
+		queue:    make(chan []T, queueSize),
+		done:     make(chan struct{}),
+	}
+	go b.run()
+	return b
+}
+
+// put ставит элементы в очередь. Если очередь заполнена, вызов ждёт
+// освобождения места.
+func (b *batcher[T]) put(items []T) error {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	if b.closed {
+		return ErrShuttingDown
+	}
+	b.queue <- items
+	return nil
+}
+
+// offer ставит элементы в очередь без ожидания и возвращает errQueueFull,
+// если места нет.
+func (b *batcher[T]) offer(items []T) error {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	if b.closed {
+		return ErrShuttingDown
+	}
+	select {
+	case b.queue <- items:
+		return nil
+	default:
+		return errQueueFull
+	}
+}
+
+// queued возвращает заполнение очереди и её ёмкость.
+func (b *batcher[T]) queued() (n, capacity int) {
+	return len(b.queue), cap(b.queue)
+}
+
+// close перестаёт принимать элементы и ждёт, пока все уже поставленные
+// в очередь будут переданы flush.
+func (b *batcher[T]) close() {
+	b.mu.Lock()
+	if !b.closed {
+		b.closed = true
+		close(b.queue)
+	}
+	b.mu.Unlock()
+	<-b.done
+}
+
+func (b *batcher[T]) run() {
+	defer close(b.done)
+
+	ticker := time.NewTicker(b.interval)
+	defer ticker.Stop()
+
+	batch := make([]T, 0, b.size)
+	for {
+		select {
+		case items, ok := <-b.queue:
+			if !ok {
+				b.flush(batch)
+				return
+			}
+			batch = append(batch, items...)
+			if len(batch) >= b.size {
+				b.flush(batch)
+				batch = batch[:0]
+			}
+		case <-ticker.C:
+			b.flush(batch)
+			batch = batch[:0]
+		}
+	}
+}
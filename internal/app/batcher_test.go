@@ -0,0 +1,54 @@
+package app
+
+import (
+	"errors"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestBatcher(t *testing.T) {
+	release := make(chan struct{})
+	var batches [][]int
+	b := newBatcher(2, time.Hour, 1, func(batch []int) {
+		if len(batch) == 0 {
+			return
+		}
+		<-release
+		batches = append(batches, slices.Clone(batch))
+	})
+
+	// Запись первого пакета стоит, поэтому очередь рано или поздно заполнится
+	var err error
+	n := 0
+	for ; n < 10; n++ {
+		if err = b.offer([]int{n}); err != nil {
+			break
+		}
+	}
+	if !errors.Is(err, errQueueFull) {
+		t.Fatalf("Expected errQueueFull, got %v", err)
+	}
+
+	close(release)
+	b.close()
+	if err := b.put([]int{n}); !errors.Is(err, ErrShuttingDown) {
+		t.Errorf("Expected ErrShuttingDown after close, got %v", err)
+	}
+
+	// Все принятые элементы записаны, пакеты не больше size
+	var got []int
+	for _, batch := range batches {
+		if len(batch) > 2 {
+			t.Errorf("Expected batches of at most 2, got %v", batch)
+		}
+		got = append(got, batch...)
+	}
+	want := make([]int, n)
+	for i := range want {
+		want[i] = i
+	}
+	if !slices.Equal(got, want) {
+		t.Errorf("Expected %v to be flushed, got %v", want, got)
+	}
+}
@@ -0,0 +1,407 @@
+package app
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"math"
+	"math/bits"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/vvityuk/shortener/internal/storage"
+	"go.uber.org/zap"
+)
+
+const (
+	// visitorExactLimit — до скольких посетителей ссылки они считаются
+	// точно. Дальше множество заменяется приближённой оценкой.
+	visitorExactLimit = 512
+	// sketchBits задаёт число регистров оценки HyperLogLog: 2^sketchBits
+	// байт на ссылку, погрешность около 1.04/sqrt(2^sketchBits) ≈ 3%.
+	sketchBits = 10
+	sketchSize = 1 << sketchBits
+)
+
+// clickRecord — одна запись файла переходов (JSON Lines): либо событие
+// перехода, либо сводка по ссылке, которую оставляет сжатие файла.
+// У сводки Total больше нуля, а At — время первого учтённого перехода.
+type clickRecord struct {
+	ShortURL  string    `json:"short_url"`
+	At        time.Time `json:"at"`
+	Referrer  string    `json:"referrer,omitempty"`
+	UserAgent string    `json:"user_agent,omitempty"`
+	IP        string    `json:"ip,omitempty"`
+
+	Total    int           `json:"total,omitempty"`
+	Hours    map[int64]int `json:"hours,omitempty"`
+	Visitors []uint64      `json:"visitors,omitempty"`
+	Sketch   []byte        `json:"sketch,omitempty"`
+}
+
+// linkClicks — накопленная статистика переходов по одной ссылке.
+type linkClicks struct {
+	total    int
+	first    time.Time
+	visitors visitorSet
+	hours    map[int64]int // начало часа (Unix) -> число переходов
+}
+
+// visitorSet считает разных посетителей ссылки. Первые visitorExactLimit
+// хешей хранятся как есть, после этого множество превращается
+// в оценку HyperLogLog фиксированного размера.
+type visitorSet struct {
+	exact  map[uint64]struct{}
+	sketch []uint8 // nil, пока счёт точный
+}
+
+func (v *visitorSet) add(h uint64) {
+	if v.sketch != nil {
+		sketchAdd(v.sketch, h)
+		return
+	}
+	if v.exact == nil {
+		v.exact = make(map[uint64]struct{})
+	}
+	v.exact[h] = struct{}{}
+	if len(v.exact) > visitorExactLimit {
+		v.toSketch()
+	}
+}
+
+// merge добавляет посетителей из сводки.
+func (v *visitorSet) merge(hashes []uint64, sketch []uint8) {
+	if sketch != nil {
+		if v.sketch == nil {
+			v.toSketch()
+		}
+		for i, r := range sketch {
+			v.sketch[i] = max(v.sketch[i], r)
+		}
+	}
+	for _, h := range hashes {
+		v.add(h)
+	}
+}
+
+func (v *visitorSet) toSketch() {
+	v.sketch = make([]uint8, sketchSize)
+	for h := range v.exact {
+		sketchAdd(v.sketch, h)
+	}
+	v.exact = nil
+}
+
+func (v *visitorSet) len() int {
+	if v.sketch == nil {
+		return len(v.exact)
+	}
+	m := float64(sketchSize)
+	sum, zeros := 0.0, 0
+	for _, r := range v.sketch {
+		sum += math.Ldexp(1, -int(r))
+		if r == 0 {
+			zeros++
+		}
+	}
+	estimate := 0.7213 / (1 + 1.079/m) * m * m / sum
+	if estimate <= 2.5*m && zeros > 0 {
+		// Для небольших множеств точнее линейный счёт
+		estimate = m * math.Log(m/float64(zeros))
+	}
+	return int(math.Round(estimate))
+}
+
+// hashes возвращает точное множество для записи в сводку.
+func (v *visitorSet) hashes() []uint64 {
+	hashes := make([]uint64, 0, len(v.exact))
+	for h := range v.exact {
+		hashes = append(hashes, h)
+	}
+	sort.Slice(hashes, func(i, j int) bool { return hashes[i] < hashes[j] })
+	return hashes
+}
+
+func sketchAdd(sketch []uint8, h uint64) {
+	i := h >> (64 - sketchBits)
+	rank := uint8(bits.LeadingZeros64(h<<sketchBits|1<<(sketchBits-1))) + 1
+	sketch[i] = max(sketch[i], rank)
+}
+
+// visitorHash — хеш посетителя: пары анонимизированного IP и User-Agent.
+// Хеши сохраняются в сводках, поэтому функция не должна меняться.
+func visitorHash(ip, userAgent string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(ip))
+	h.Write([]byte{0})
+	h.Write([]byte(userAgent))
+	// Перемешивание splitmix64: оценке нужны равномерные старшие биты
+	x := h.Sum64()
+	x = (x ^ x>>30) * 0xbf58476d1ce4e5b9
+	x = (x ^ x>>27) * 0x94d049bb133111eb
+	return x ^ x>>31
+}
+
+// clickLog хранит статистику переходов для хранилищ в памяти и в файле.
+// Сами события не хранятся в памяти: для каждой ссылки копятся только
+// счётчики по часам и посетители. Файловое хранилище дописывает события
+// в отдельный файл и при запуске восстанавливает по нему счётчики. Когда
+// событий становится заметно больше, чем ссылок, файл сжимается
+// в сводки по ссылкам.
+type clickLog struct {
+	// writeMu упорядочивает запись в файл и его сжатие, mu защищает
+	// счётчики. Сжатие пишет файл под writeMu, не задерживая stats.
+	writeMu sync.Mutex
+	mu      sync.Mutex
+	links   map[string]*linkClicks
+	file    *os.File // nil для хранилища в памяти
+	path    string
+	records int // строк в файле
+	logger  *zap.Logger
+}
+
+func newClickLog() *clickLog {
+	return &clickLog{links: make(map[string]*linkClicks)}
+}
+
+// openClickLog открывает файл переходов path и повторяет его записи.
+// keep отбирает переходы, относящиеся к существующим ссылкам.
+func openClickLog(path string, keep func(storage.Click) bool, logger *zap.Logger) (*clickLog, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	l := newClickLog()
+	l.file, l.path, l.logger = file, path, logger
+
+	reader := bufio.NewReader(file)
+	var offset int64 // конец последней корректной записи
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err != nil && err != io.EOF {
+			file.Close()
+			return nil, err
+		}
+		if len(line) == 0 {
+			break
+		}
+		var rec clickRecord
+		decodeErr := json.Unmarshal(line, &rec)
+		if decodeErr == nil && rec.Sketch != nil && len(rec.Sketch) != sketchSize {
+			decodeErr = errors.New("invalid visitor sketch size")
+		}
+		if decodeErr != nil {
+			// Недописанная последняя строка отбрасывается, как и в журнале ссылок
+			if _, peekErr := reader.Peek(1); peekErr == nil {
+				file.Close()
+				return nil, fmt.Errorf("corrupted click record at offset %d: %w", offset, decodeErr)
+			}
+			if err := file.Truncate(offset); err != nil {
+				file.Close()
+				return nil, err
+			}
+			break
+		}
+		offset += int64(len(line))
+		l.records++
+		if line[len(line)-1] != '\n' {
+			if _, err := file.Write([]byte{'\n'}); err != nil {
+				file.Close()
+				return nil, err
+			}
+		}
+		if keep(storage.Click{ShortURL: rec.ShortURL, At: rec.At}) {
+			l.apply(rec)
+		}
+	}
+
+	// При открытии переходы ещё не пишутся, поэтому файл сжимается сразу
+	if l.needsCompaction() {
+		if err := l.compact(); err != nil {
+			logger.Error("failed to compact clicks", zap.String("path", path), zap.Error(err))
+		}
+	}
+	return l, nil
+}
+
+// apply учитывает запись файла: сводку или одно событие.
+func (l *clickLog) apply(rec clickRecord) {
+	if rec.Total == 0 {
+		l.add(storage.Click{ShortURL: rec.ShortURL, At: rec.At, Referrer: rec.Referrer, UserAgent: rec.UserAgent, IP: rec.IP})
+		return
+	}
+	lc := l.link(rec.ShortURL, rec.At)
+	lc.total += rec.Total
+	for hour, n := range rec.Hours {
+		lc.hours[hour] += n
+	}
+	lc.visitors.merge(rec.Visitors, rec.Sketch)
+}
+
+// record сохраняет переходы: сначала в файл одной операцией записи, затем
+// в счётчики.
+func (l *clickLog) record(clicks []storage.Click) error {
+	l.writeMu.Lock()
+	defer l.writeMu.Unlock()
+	if l.file != nil {
+		var buf bytes.Buffer
+		encoder := json.NewEncoder(&buf)
+		for _, c := range clicks {
+			rec := clickRecord{ShortURL: c.ShortURL, At: c.At.UTC(), Referrer: c.Referrer, UserAgent: c.UserAgent, IP: c.IP}
+			if err := encoder.Encode(rec); err != nil {
+				return err
+			}
+		}
+		if _, err := l.file.Write(buf.Bytes()); err != nil {
+			return err
+		}
+	}
+
+	l.mu.Lock()
+	for _, c := range clicks {
+		l.add(c)
+	}
+	l.records += len(clicks)
+	compact := l.file != nil && l.needsCompaction()
+	l.mu.Unlock()
+
+	// Сжатие — лишь оптимизация: переходы уже записаны
+	if compact {
+		if err := l.compact(); err != nil {
+			l.logger.Error("failed to compact clicks", zap.String("path", l.path), zap.Error(err))
+		}
+	}
+	return nil
+}
+
+func (l *clickLog) link(shortURL string, at time.Time) *linkClicks {
+	lc, ok := l.links[shortURL]
+	if !ok {
+		lc = &linkClicks{first: at, hours: make(map[int64]int)}
+		l.links[shortURL] = lc
+	}
+	if at.Before(lc.first) {
+		lc.first = at
+	}
+	return lc
+}
+
+func (l *clickLog) add(c storage.Click) {
+	lc := l.link(c.ShortURL, c.At)
+	lc.total++
+	lc.visitors.add(visitorHash(c.IP, c.UserAgent))
+	lc.hours[storage.BucketStart(c.At, storage.BucketHour).Unix()]++
+}
+
+func (l *clickLog) needsCompaction() bool {
+	return l.records >= compactMinRecords && l.records > 2*len(l.links)
+}
+
+// compact заменяет файл переходов сводками по ссылкам. Вызывается под
+// writeMu: пока пишется новый файл, переходы в старый не дописываются.
+// При ошибке продолжается запись в прежний файл.
+func (l *clickLog) compact() error {
+	l.mu.Lock()
+	snapshot := l.snapshot()
+	l.mu.Unlock()
+
+	tmpPath := l.path + ".tmp"
+	tmp, err := writeSnapshot(tmpPath, snapshot)
+	if err != nil {
+		return err
+	}
+	if err := os.Rename(tmpPath, l.path); err != nil {
+		tmp.Close()
+		os.Remove(tmpPath)
+		return err
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.file.Close()
+	l.file = tmp
+	l.records = len(snapshot)
+	return nil
+}
+
+// snapshot возвращает сводки по всем ссылкам. Вызывается под mu.
+func (l *clickLog) snapshot() []clickRecord {
+	keys := make([]string, 0, len(l.links))
+	for key := range l.links {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	records := make([]clickRecord, 0, len(keys))
+	for _, key := range keys {
+		lc := l.links[key]
+		hours := make(map[int64]int, len(lc.hours))
+		for hour, n := range lc.hours {
+			hours[hour] = n
+		}
+		rec := clickRecord{ShortURL: key, At: lc.first.UTC(), Total: lc.total, Hours: hours}
+		if lc.visitors.sketch != nil {
+			rec.Sketch = append([]byte(nil), lc.visitors.sketch...)
+		} else {
+			rec.Visitors = lc.visitors.hashes()
+		}
+		records = append(records, rec)
+	}
+	return records
+}
+
+// stats возвращает статистику ссылки. Ряд содержит только непустые интервалы.
+func (l *clickLog) stats(shortURL string, q storage.StatsQuery) storage.ClickStats {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	lc, ok := l.links[shortURL]
+	if !ok {
+		return storage.ClickStats{}
+	}
+
+	buckets := make(map[time.Time]int)
+	for hour, n := range lc.hours {
+		t := time.Unix(hour, 0)
+		if t.Before(q.From) || !t.Before(q.To) {
+			continue
+		}
+		buckets[storage.BucketStart(t, q.Bucket)] += n
+	}
+	series := make([]storage.ClickBucket, 0, len(buckets))
+	for start, n := range buckets {
+		series = append(series, storage.ClickBucket{Start: start, Clicks: n})
+	}
+	sort.Slice(series, func(i, j int) bool { return series[i].Start.Before(series[j].Start) })
+	return storage.ClickStats{Total: lc.total, Unique: lc.visitors.len(), Series: series}
+}
+
+// drop забывает переходы удалённых ссылок, чтобы ссылка, получившая
+// освободившийся код, начинала с нуля.
+func (l *clickLog) drop(keys []string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, key := range keys {
+		delete(l.links, key)
+	}
+}
+
+func (l *clickLog) close() error {
+	l.writeMu.Lock()
+	defer l.writeMu.Unlock()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.file == nil {
+		return nil
+	}
+	if err := l.file.Sync(); err != nil {
+		l.file.Close()
+		return err
+	}
+	return l.file.Close()
+}
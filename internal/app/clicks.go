@@ -0,0 +1,143 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"sync/atomic"
+	"time"
+
+	"github.com/vvityuk/shortener/internal/storage"
+	"go.uber.org/zap"
+)
+
+const (
+	// clickBatchSize — сколько переходов копится до записи в хранилище.
+	clickBatchSize = 500
+	// clickFlushInterval — как долго неполный пакет ждёт записи.
+	clickFlushInterval = time.Second
+	// clickQueueSize — ёмкость очереди переходов от обработчиков.
+	clickQueueSize = 4096
+)
+
+// clickRecorder пишет переходы в хранилище пакетами в фоне. В отличие
+// от deleter он никогда не задерживает обработчик: если очередь
+// заполнена, переход отбрасывается и учитывается в счётчике потерь.
+type clickRecorder struct {
+	storage Storage
+	logger  *zap.Logger
+	batcher *batcher[storage.Click]
+	dropped atomic.Int64
+}
+
+func newClickRecorder(store Storage, logger *zap.Logger) *clickRecorder {
+	c := &clickRecorder{storage: store, logger: logger}
+	c.batcher = newBatcher(clickBatchSize, clickFlushInterval, clickQueueSize, c.flush)
+	return c
+}
+
+// record ставит переход в очередь без ожидания. После close переходы
+// не принимаются.
+func (c *clickRecorder) record(click storage.Click) {
+	if err := c.batcher.offer([]storage.Click{click}); errors.Is(err, errQueueFull) {
+		c.dropped.Add(1)
+	}
+}
+
+// close перестаёт принимать переходы и ждёт записи уже поставленных в очередь.
+func (c *clickRecorder) close() {
+	c.batcher.close()
+}
+
+func (c *clickRecorder) flush(batch []storage.Click) {
+	if n := c.dropped.Swap(0); n > 0 {
+		c.logger.Warn("click queue is full, clicks dropped", zap.Int64("count", n))
+	}
+	if len(batch) == 0 {
+		return
+	}
+	if err := c.storage.RecordClicks(context.Background(), batch); err != nil {
+		c.logger.Error("failed to record clicks", zap.Int("count", len(batch)), zap.Error(err))
+	}
+}
+
+// anonymizeIP обнуляет младшие биты адреса: последний октет IPv4
+// и последние 80 бит IPv6. addr может содержать порт. Нераспознанный
+// адрес превращается в пустую строку.
+func anonymizeIP(addr string) string {
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		addr = host
+	}
+	ip, err := netip.ParseAddr(addr)
+	if err != nil {
+		return ""
+	}
+	ip = ip.Unmap()
+	bits := 48
+	if ip.Is4() {
+		bits = 24
+	}
+	prefix, err := ip.Prefix(bits)
+	if err != nil {
+		return ""
+	}
+	return prefix.Addr().String()
+}
+
+// maxStatsBuckets ограничивает длину ряда статистики.
+const maxStatsBuckets = 1000
+
+// ErrInvalidStatsQuery возвращается для неверных параметров статистики.
+var ErrInvalidStatsQuery = errors.New("invalid stats query")
+
+// RecordClick ставит переход в очередь записи, не дожидаясь её.
+func (s *Service) RecordClick(click storage.Click) {
+	s.clicks.record(click)
+}
+
+// ClickStats возвращает статистику переходов по ссылке. Промежуток
+// расширяется до границ интервалов, а ряд содержит все интервалы
+// промежутка, в том числе пустые.
+func (s *Service) ClickStats(ctx context.Context, shortCode string, q storage.StatsQuery) (storage.ClickStats, error) {
+	if q.Bucket != storage.BucketHour && q.Bucket != storage.BucketDay {
+		return storage.ClickStats{}, fmt.Errorf("%w: bucket must be %s or %s", ErrInvalidStatsQuery, storage.BucketHour, storage.BucketDay)
+	}
+	step := bucketStep(q.Bucket)
+	q.From = storage.BucketStart(q.From, q.Bucket)
+	if !q.From.Before(q.To) {
+		return storage.ClickStats{}, fmt.Errorf("%w: from must be before to", ErrInvalidStatsQuery)
+	}
+	if q.To.Sub(q.From) > maxStatsBuckets*step {
+		return storage.ClickStats{}, fmt.Errorf("%w: range exceeds %d buckets", ErrInvalidStatsQuery, maxStatsBuckets)
+	}
+
+	if _, err := s.storage.Get(ctx, shortCode); err != nil {
+		return storage.ClickStats{}, err
+	}
+	stats, err := s.storage.ClickStats(ctx, shortCode, q)
+	if err != nil {
+		return storage.ClickStats{}, err
+	}
+
+	series := make([]storage.ClickBucket, 0, int(q.To.Sub(q.From)/step)+1)
+	next := 0
+	for start := q.From; start.Before(q.To); start = start.Add(step) {
+		bucket := storage.ClickBucket{Start: start}
+		if next < len(stats.Series) && stats.Series[next].Start.Equal(start) {
+			bucket.Clicks = stats.Series[next].Clicks
+			next++
+		}
+		series = append(series, bucket)
+	}
+	stats.Series = series
+	return stats, nil
+}
+
+func bucketStep(bucket string) time.Duration {
+	if bucket == storage.BucketDay {
+		return 24 * time.Hour
+	}
+	return time.Hour
+}
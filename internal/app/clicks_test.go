@@ -0,0 +1,260 @@
+package app
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/vvityuk/shortener/internal/config"
+	appstorage "github.com/vvityuk/shortener/internal/storage"
+	"go.uber.org/zap"
+)
+
+func TestAnonymizeIP(t *testing.T) {
+	tests := []struct {
+		addr     string
+		expected string
+	}{
+		{"192.168.1.77:5555", "192.168.1.0"},
+		{"10.0.0.1", "10.0.0.0"},
+		{"[2001:db8:85a3:1234:5678:8a2e:370:7334]:443", "2001:db8:85a3::"},
+		{"[::ffff:192.168.1.77]:80", "192.168.1.0"},
+		{"not an ip", ""},
+	}
+	for _, tt := range tests {
+		if got := anonymizeIP(tt.addr); got != tt.expected {
+			t.Errorf("anonymizeIP(%q) = %q, expected %q", tt.addr, got, tt.expected)
+		}
+	}
+}
+
+func TestClickStats(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "urls.json")
+	fileStorage, err := NewStorage(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	day := time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC)
+	if _, err := fileStorage.Save(ctx, appstorage.URL{ShortURL: "abc", OriginalURL: "https://ya.ru", CreatedAt: day}); err != nil {
+		t.Fatal(err)
+	}
+	service, err := newService(fileStorage, &config.Config{BaseURL: "http://localhost:8080"}, zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, c := range []appstorage.Click{
+		{At: day.Add(10 * time.Minute), IP: "10.0.0.0", UserAgent: "curl"},
+		{At: day.Add(20 * time.Minute), IP: "10.0.0.0", UserAgent: "curl"},
+		{At: day.Add(2 * time.Hour), IP: "10.0.1.0", UserAgent: "curl"},
+		{At: day.Add(26 * time.Hour), IP: "10.0.0.0", UserAgent: "firefox"},
+	} {
+		c.ShortURL = "abc"
+		service.RecordClick(c)
+	}
+	service.RecordClick(appstorage.Click{ShortURL: "missing", At: day})
+	// Close дожидается записи очереди переходов
+	if err := service.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Статистика восстанавливается из файла переходов
+	fileStorage, err = NewStorage(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	service, err = newService(fileStorage, &config.Config{BaseURL: "http://localhost:8080"}, zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer service.Close()
+
+	stats, err := service.ClickStats(ctx, "abc", appstorage.StatsQuery{Bucket: appstorage.BucketHour, From: day.Add(30 * time.Minute), To: day.Add(3 * time.Hour)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Total != 4 || stats.Unique != 3 {
+		t.Errorf("Expected 4 clicks from 3 visitors, got %d from %d", stats.Total, stats.Unique)
+	}
+	expected := []int{2, 0, 1}
+	if len(stats.Series) != len(expected) {
+		t.Fatalf("Expected %d hourly buckets, got %+v", len(expected), stats.Series)
+	}
+	for i, n := range expected {
+		if !stats.Series[i].Start.Equal(day.Add(time.Duration(i)*time.Hour)) || stats.Series[i].Clicks != n {
+			t.Errorf("Expected bucket %d to have %d clicks, got %+v", i, n, stats.Series[i])
+		}
+	}
+
+	stats, err = service.ClickStats(ctx, "abc", appstorage.StatsQuery{Bucket: appstorage.BucketDay, From: day, To: day.Add(48 * time.Hour)})
+	if err != nil || len(stats.Series) != 2 || stats.Series[0].Clicks != 3 || stats.Series[1].Clicks != 1 {
+		t.Errorf("Expected daily buckets of 3 and 1 clicks, got %+v (err: %v)", stats.Series, err)
+	}
+
+	for _, q := range []appstorage.StatsQuery{
+		{Bucket: "week", From: day, To: day.Add(time.Hour)},
+		{Bucket: appstorage.BucketHour, From: day, To: day},
+		{Bucket: appstorage.BucketHour, From: day, To: day.AddDate(1, 0, 0)},
+	} {
+		if _, err := service.ClickStats(ctx, "abc", q); !errors.Is(err, ErrInvalidStatsQuery) {
+			t.Errorf("Expected ErrInvalidStatsQuery for %+v, got %v", q, err)
+		}
+	}
+	if _, err := service.ClickStats(ctx, "missing", appstorage.StatsQuery{Bucket: appstorage.BucketDay, From: day, To: day.Add(time.Hour)}); !errors.Is(err, appstorage.ErrNotFound) {
+		t.Errorf("Expected ErrNotFound for unknown link, got %v", err)
+	}
+}
+
+func TestURLStatsHandler(t *testing.T) {
+	service, err := newService(NewMemoryStorage(), &config.Config{BaseURL: "http://localhost:8080"}, zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer service.Close()
+	code, err := service.CreateURL(context.Background(), "https://ya.ru", CreateOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := NewHandler(service)
+	r := chi.NewRouter()
+	r.Get("/{shortCode}", handler.GetURL)
+	r.Get("/api/urls/{shortCode}/stats", handler.URLStats)
+
+	for _, agent := range []string{"curl", "curl", "firefox"} {
+		req := httptest.NewRequest(http.MethodGet, "/"+code, nil)
+		req.Header.Set("User-Agent", agent)
+		r.ServeHTTP(httptest.NewRecorder(), req)
+	}
+	service.clicks.close()
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/urls/"+code+"/stats?bucket=hour", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status %d, got %d", http.StatusOK, w.Code)
+	}
+	var resp statsResponse
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+	inSeries := 0
+	for _, b := range resp.Series {
+		inSeries += b.Clicks
+	}
+	if resp.TotalClicks != 3 || resp.UniqueVisitors != 2 || len(resp.Series) != 25 || inSeries != 3 {
+		t.Errorf("Unexpected stats %+v", resp)
+	}
+
+	for _, tt := range []struct {
+		path   string
+		status int
+	}{
+		{"/api/urls/" + code + "/stats?bucket=week", http.StatusBadRequest},
+		{"/api/urls/" + code + "/stats?from=yesterday", http.StatusBadRequest},
+		{"/api/urls/missing/stats", http.StatusNotFound},
+	} {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, tt.path, nil))
+		if w.Code != tt.status {
+			t.Errorf("Expected status %d for %s, got %d", tt.status, tt.path, w.Code)
+		}
+	}
+}
+
+func TestClickLogCompaction(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "urls.json.clicks")
+	keep := func(appstorage.Click) bool { return true }
+	clicks, err := openClickLog(path, keep, zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	day := time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC)
+	visitors := visitorExactLimit * 4
+	for i := 0; i < compactMinRecords*3; i++ {
+		c := appstorage.Click{ShortURL: "abc", At: day.Add(time.Duration(i) * time.Minute), IP: fmt.Sprintf("10.0.%d.0", i%visitors), UserAgent: "curl"}
+		if err := clicks.record([]appstorage.Click{c}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := clicks.record([]appstorage.Click{{ShortURL: "def", At: day, IP: "10.0.0.0"}}); err != nil {
+		t.Fatal(err)
+	}
+	q := appstorage.StatsQuery{Bucket: appstorage.BucketDay, From: day, To: day.AddDate(0, 0, 7)}
+	before := clicks.stats("abc", q)
+	if err := clicks.close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Файл сжат в сводки, а не хранит все события
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lines := bytes.Count(data, []byte{'\n'}); lines >= compactMinRecords {
+		t.Errorf("Expected compacted clicks file, got %d lines", lines)
+	}
+
+	clicks, err = openClickLog(path, keep, zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	after := clicks.stats("abc", q)
+	if after.Total != compactMinRecords*3 || after.Total != before.Total || after.Unique != before.Unique {
+		t.Errorf("Expected stats to survive compaction, got %+v, before %+v", after, before)
+	}
+	if !slices.Equal(after.Series, before.Series) {
+		t.Errorf("Expected series %+v, got %+v", before.Series, after.Series)
+	}
+	if diff := math.Abs(float64(after.Unique-visitors)) / float64(visitors); diff > 0.1 {
+		t.Errorf("Expected about %d visitors, got %d", visitors, after.Unique)
+	}
+	if stats := clicks.stats("def", q); stats.Total != 1 || stats.Unique != 1 {
+		t.Errorf("Expected 1 click from 1 visitor, got %+v", stats)
+	}
+
+	// Сводки удалённых ссылок при повторе отбрасываются, как и события
+	clicks.close()
+	clicks, err = openClickLog(path, func(c appstorage.Click) bool { return c.ShortURL != "abc" }, zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer clicks.close()
+	if stats := clicks.stats("abc", q); stats.Total != 0 {
+		t.Errorf("Expected dropped link to have no clicks, got %+v", stats)
+	}
+}
+
+func TestVisitorSet(t *testing.T) {
+	for _, n := range []int{0, 1, visitorExactLimit, visitorExactLimit + 1, 10000, 200000} {
+		var v visitorSet
+		for i := 0; i < n; i++ {
+			h := visitorHash(strconv.Itoa(i), "curl")
+			v.add(h)
+			v.add(h)
+		}
+		got := v.len()
+		if n <= visitorExactLimit && got != n {
+			t.Errorf("Expected exact count %d, got %d", n, got)
+		}
+		if diff := math.Abs(float64(got-n)) / float64(max(n, 1)); diff > 0.1 {
+			t.Errorf("Expected about %d visitors, got %d", n, got)
+		}
+		if n > visitorExactLimit && (v.exact != nil || len(v.sketch) != sketchSize) {
+			t.Errorf("Expected %d visitors to be kept in a fixed-size sketch", n)
+		}
+	}
+}
@@ -0,0 +1,166 @@
+package app
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"fmt"
+	"math/big"
+	"strings"
+	"sync/atomic"
+
+	"github.com/vvityuk/shortener/internal/config"
+)
+
+const codeAlphabet = "0123456789abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ"
+
+// collisionsBeforeGrow — сколько коллизий подряд на текущей длине кода
+// допускается, прежде чем случайный генератор перейдёт на код длиннее.
+const collisionsBeforeGrow = 2
+
+// CodeGenerator выдаёт короткие коды для новых ссылок.
+type CodeGenerator interface {
+	// Generate возвращает код для originalURL. attempt — номер попытки,
+	// начиная с нуля: если код оказался занят, сервис повторяет вызов
+	// с attempt+1 и ожидает получить другой код.
+	Generate(ctx context.Context, originalURL string, attempt int) (string, error)
+}
+
+// Sequencer — хранилище, способное выдавать монотонно растущие номера
+// для последовательной стратегии кодов.
+type Sequencer interface {
+	NextSequence(ctx context.Context) (uint64, error)
+}
+
+// NewCodeGenerator создаёт генератор кодов по названию стратегии из конфигурации.
+// Последовательной стратегии нужно хранилище, реализующее Sequencer.
+func NewCodeGenerator(strategy string, minLength int, storage Storage) (CodeGenerator, error) {
+	if minLength < 1 {
+		minLength = config.DefaultShortCodeLength
+	}
+
+	switch strategy {
+	case config.CodeStrategyRandom, "":
+		return newRandomGenerator(minLength, config.MaxShortCodeLength), nil
+	case config.CodeStrategySequential:
+		seq, ok := storage.(Sequencer)
+		if !ok {
+			return nil, fmt.Errorf("storage %T does not support sequential codes", storage)
+		}
+		return &sequentialGenerator{seq: seq, minLength: minLength}, nil
+	case config.CodeStrategyHash:
+		return &hashGenerator{minLength: minLength, maxLength: config.MaxShortCodeLength}, nil
+	default:
+		return nil, fmt.Errorf("unknown code strategy %q", strategy)
+	}
+}
+
+// randomGenerator выдаёт случайные коды из криптографически стойкого
+// источника. Длина кода начинается с минимальной и растёт, когда пространство
+// кодов текущей длины заполняется и коллизии становятся частыми.
+type randomGenerator struct {
+	length    atomic.Int64
+	maxLength int
+}
+
+func newRandomGenerator(minLength, maxLength int) *randomGenerator {
+	g := &randomGenerator{maxLength: maxLength}
+	g.length.Store(int64(minLength))
+	return g
+}
+
+func (g *randomGenerator) Generate(_ context.Context, _ string, attempt int) (string, error) {
+	length := g.length.Load()
+	if attempt >= collisionsBeforeGrow && length < int64(g.maxLength) {
+		// CAS, чтобы одновременные запросы не увеличили длину несколько раз
+		g.length.CompareAndSwap(length, length+1)
+		length = g.length.Load()
+	}
+	return randomCode(int(length))
+}
+
+// sequentialGenerator кодирует в base62 номера из счётчика хранилища.
+// Коды предсказуемы и удобны для тестов, но легко перебираются.
+type sequentialGenerator struct {
+	seq       Sequencer
+	minLength int
+}
+
+func (g *sequentialGenerator) Generate(ctx context.Context, _ string, _ int) (string, error) {
+	n, err := g.seq.NextSequence(ctx)
+	if err != nil {
+		return "", err
+	}
+	return padCode(encodeBase62(new(big.Int).SetUint64(n)), g.minLength), nil
+}
+
+// hashGenerator выводит код из SHA-256 исходного URL, поэтому один и тот же
+// URL получает один и тот же код на любом экземпляре сервиса. При коллизии
+// с другим URL код удлиняется на attempt символов.
+type hashGenerator struct {
+	minLength int
+	maxLength int
+}
+
+func (g *hashGenerator) Generate(_ context.Context, originalURL string, attempt int) (string, error) {
+	length := g.minLength + attempt
+	if length > g.maxLength {
+		return "", errCodeSpaceExhausted
+	}
+	sum := sha256.Sum256([]byte(originalURL))
+	// 256 бит дают 43 символа base62, этого хватает для любой допустимой длины.
+	// Берём младшие разряды: в отличие от старших они распределены равномерно.
+	code := padCode(encodeBase62(new(big.Int).SetBytes(sum[:])), g.maxLength)
+	return code[len(code)-length:], nil
+}
+
+// encodeBase62 записывает n в алфавите codeAlphabet.
+func encodeBase62(n *big.Int) string {
+	if n.Sign() == 0 {
+		return codeAlphabet[:1]
+	}
+	base := big.NewInt(int64(len(codeAlphabet)))
+	mod := new(big.Int)
+	var b []byte
+	for n = new(big.Int).Set(n); n.Sign() > 0; {
+		n.DivMod(n, base, mod)
+		b = append(b, codeAlphabet[mod.Int64()])
+	}
+	for i, j := 0, len(b)-1; i < j; i, j = i+1, j-1 {
+		b[i], b[j] = b[j], b[i]
+	}
+	return string(b)
+}
+
+// padCode дополняет код ведущими нулями до длины n.
+func padCode(code string, n int) string {
+	if len(code) >= n {
+		return code
+	}
+	return strings.Repeat(codeAlphabet[:1], n-len(code)) + code
+}
+
+// randomCode возвращает случайную строку из codeAlphabet длины n.
+func randomCode(n int) (string, error) {
+	// Отбрасываем байты >= 248, чтобы остаток от деления на 62 был равномерным
+	const limit = 256 - 256%len(codeAlphabet)
+
+	b := make([]byte, n)
+	buf := make([]byte, n+n/2)
+	for i := 0; i < n; {
+		if _, err := rand.Read(buf); err != nil {
+			return "", err
+		}
+		for _, c := range buf {
+			if int(c) >= limit {
+				continue
+			}
+			b[i] = codeAlphabet[int(c)%len(codeAlphabet)]
+			i++
+			if i == n {
+				break
+			}
+		}
+	}
+	return string(b), nil
+}
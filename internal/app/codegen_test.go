@@ -0,0 +1,106 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/vvityuk/shortener/internal/config"
+	"go.uber.org/zap"
+)
+
+func TestCodeGenerator(t *testing.T) {
+	// Тест алфавита и длины кода
+	t.Run("Random code", func(t *testing.T) {
+		g := newRandomGenerator(6, 8)
+		seen := make(map[string]bool)
+		for i := 0; i < 1000; i++ {
+			code, err := g.Generate(context.Background(), "", 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(code) != 6 {
+				t.Fatalf("Expected code of length 6, got %q", code)
+			}
+			for _, c := range code {
+				if !strings.ContainsRune(codeAlphabet, c) {
+					t.Fatalf("Unexpected character %q in %q", c, code)
+				}
+			}
+			seen[code] = true
+		}
+		if len(seen) < 990 {
+			t.Errorf("Expected codes to be unique, got %d distinct of 1000", len(seen))
+		}
+	})
+
+	// Тест роста длины при коллизиях
+	t.Run("Grow on collisions", func(t *testing.T) {
+		g := newRandomGenerator(1, 2)
+
+		if code, _ := g.Generate(context.Background(), "", collisionsBeforeGrow-1); len(code) != 1 {
+			t.Errorf("Expected length to stay 1 after a single collision, got %q", code)
+		}
+		if code, _ := g.Generate(context.Background(), "", collisionsBeforeGrow); len(code) != 2 {
+			t.Errorf("Expected length 2 after repeated collisions, got %q", code)
+		}
+		if code, _ := g.Generate(context.Background(), "", collisionsBeforeGrow); len(code) != 2 {
+			t.Errorf("Expected length to be capped at 2, got %q", code)
+		}
+		if code, _ := g.Generate(context.Background(), "", 0); len(code) != 2 {
+			t.Errorf("Expected length to stay 2 for later requests, got %q", code)
+		}
+	})
+
+	// Тест последовательной стратегии
+	t.Run("Sequential", func(t *testing.T) {
+		g, err := NewCodeGenerator(config.CodeStrategySequential, 3, NewMemoryStorage())
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, expected := range []string{"001", "002"} {
+			if code, _ := g.Generate(context.Background(), "", 0); code != expected {
+				t.Errorf("Expected %q, got %q", expected, code)
+			}
+		}
+	})
+
+	// Тест хеш-стратегии
+	t.Run("Hash", func(t *testing.T) {
+		g, err := NewCodeGenerator(config.CodeStrategyHash, 6, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		first, _ := g.Generate(context.Background(), "https://ya.ru", 0)
+		second, _ := g.Generate(context.Background(), "https://ya.ru", 0)
+		if first != second || len(first) != 6 {
+			t.Errorf("Expected the same 6-char code, got %q and %q", first, second)
+		}
+		if other, _ := g.Generate(context.Background(), "https://example.com", 0); other == first {
+			t.Errorf("Expected different URLs to get different codes, got %q", other)
+		}
+		if longer, _ := g.Generate(context.Background(), "https://ya.ru", 1); len(longer) != 7 {
+			t.Errorf("Expected a 7-char code on retry, got %q", longer)
+		}
+	})
+
+	// Тест заполнения пространства кодов через сервис
+	t.Run("Service retries", func(t *testing.T) {
+		service, err := newService(NewMemoryStorage(), &config.Config{ShortCodeLength: 1}, zap.NewNop())
+		if err != nil {
+			t.Fatal(err)
+		}
+		codes := make(map[string]bool)
+		for i := 0; i < 200; i++ {
+			shortURL, err := service.CreateURL(context.Background(), fmt.Sprintf("https://example.com/%d", i), CreateOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if codes[shortURL] {
+				t.Fatalf("Expected a fresh code, got %q", shortURL)
+			}
+			codes[shortURL] = true
+		}
+	})
+}
@@ -0,0 +1,330 @@
+package app
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/vvityuk/shortener/internal/storage"
+)
+
+// defaultCopyBatchSize — сколько ссылок CopyURLs сохраняет одним BatchSave.
+const defaultCopyBatchSize = 500
+
+// CopyOptions — параметры копирования ссылок между хранилищами.
+type CopyOptions struct {
+	// BatchSize — размер пакета записи, по умолчанию defaultCopyBatchSize.
+	BatchSize int
+	// DryRun — только проверить, что и как будет скопировано, ничего не записывая.
+	DryRun bool
+	// Checkpoint — файл контрольной точки. После каждого пакета в него
+	// записывается позиция в источнике, и повторный запуск продолжает
+	// с неё. Пустое значение отключает контрольные точки.
+	Checkpoint string
+	// CopyID связывает контрольную точку с конкретной парой хранилищ:
+	// контрольная точка с другим CopyID считается ошибкой.
+	CopyID string
+	// Progress, если задан, вызывается после каждого пакета.
+	Progress func(CopyReport)
+}
+
+// CopyReport — итог копирования.
+type CopyReport struct {
+	// Read — сколько ссылок прочитано из источника, включая пропущенные.
+	Read int
+	// Resumed — сколько ссылок пропущено по контрольной точке.
+	Resumed int
+	// Copied — сколько ссылок записано в приёмник (в DryRun — было бы записано).
+	Copied int
+	// Present — сколько ссылок уже было в приёмнике под тем же кодом.
+	Present int
+	// Conflicts — ссылки, которые нельзя перенести с сохранением кода.
+	Conflicts []CopyConflict
+	// Source — сводка источника, Destination — сводка ссылок приёмника
+	// с кодами из источника после копирования. В DryRun заполняется
+	// только Source.
+	Source, Destination Digest
+}
+
+// CopyConflict — ссылка, которую не удалось перенести.
+type CopyConflict struct {
+	ShortURL    string
+	OriginalURL string
+	Reason      string
+}
+
+// ErrCopyMismatch — после копирования содержимое приёмника не совпало с источником.
+var ErrCopyMismatch = errors.New("destination does not match source")
+
+// Digest — количество ссылок хранилища и их контрольная сумма. Сумма не
+// зависит от порядка обхода, поэтому сводки разных хранилищ сравнимы.
+type Digest struct {
+	Count    int
+	Checksum [sha256.Size]byte
+}
+
+// add учитывает ссылку в сводке. Время создания в сумму не входит:
+// у ссылок из старых журналов его нет, и приёмник проставляет его сам.
+// Срок действия округляется до микросекунд — точности, с которой его
+// хранит PostgreSQL. Вместо признака удаления учитывается, недоступна ли
+// ссылка к моменту now: PostgreSQL помечает удалённой истёкшую ссылку,
+// когда URL сокращают заново.
+func (d *Digest) add(u storage.URL, now time.Time) {
+	h := sha256.New()
+	for _, field := range []string{
+		u.ShortURL, u.OriginalURL, u.UserID, digestTime(u.ExpiresAt), strconv.FormatBool(u.Gone(now)),
+	} {
+		h.Write([]byte(field))
+		h.Write([]byte{0})
+	}
+	var sum [sha256.Size]byte
+	h.Sum(sum[:0])
+	for i := range d.Checksum {
+		d.Checksum[i] ^= sum[i]
+	}
+	d.Count++
+}
+
+func (d Digest) String() string {
+	return fmt.Sprintf("%d links, checksum %s", d.Count, hex.EncodeToString(d.Checksum[:]))
+}
+
+func digestTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.UTC().Truncate(time.Microsecond).Format(time.RFC3339Nano)
+}
+
+// StorageDigest обходит хранилище и возвращает его сводку.
+func StorageDigest(ctx context.Context, s Storage) (Digest, error) {
+	return storageDigest(ctx, s, time.Now(), nil)
+}
+
+// storageDigest возвращает сводку ссылок хранилища на момент now. Если codes
+// не nil, в сводку попадают только ссылки с этими кодами.
+func storageDigest(ctx context.Context, s Storage, now time.Time, codes map[string]struct{}) (Digest, error) {
+	var d Digest
+	err := s.ForEach(ctx, func(u storage.URL) error {
+		if _, ok := codes[u.ShortURL]; codes == nil || ok {
+			d.add(u, now)
+		}
+		return nil
+	})
+	return d, err
+}
+
+// copyCheckpoint — содержимое файла контрольной точки. ForEach обходит
+// неизменное хранилище в одном и том же порядке, поэтому позиции и кода
+// последней обработанной ссылки достаточно, чтобы продолжить обход.
+type copyCheckpoint struct {
+	CopyID   string `json:"copy_id"`
+	Position int    `json:"position"`
+	ShortURL string `json:"short_url"`
+}
+
+// CopyURLs переносит все ссылки из from в to с сохранением кодов, владельцев,
+// сроков действия и времени создания (если оно известно). Ссылки, которые уже есть в приёмнике
+// под тем же кодом, пропускаются, поэтому копирование можно безопасно
+// повторять. Если URL или код в приёмнике уже заняты другой ссылкой,
+// ссылка попадает в CopyReport.Conflicts.
+//
+// После копирования CopyURLs сравнивает сводку источника со сводкой ссылок
+// приёмника под теми же кодами и возвращает ErrCopyMismatch, если они
+// разошлись. Остальные ссылки приёмника в сверке не участвуют, поэтому
+// копировать можно и в непустое хранилище. Контрольная точка удаляется
+// только после успешной сверки.
+func CopyURLs(ctx context.Context, from, to Storage, opts CopyOptions) (CopyReport, error) {
+	if opts.BatchSize <= 0 {
+		opts.BatchSize = defaultCopyBatchSize
+	}
+	var report CopyReport
+	// Доступность ссылок в сводках оценивается на один момент времени
+	now := time.Now()
+	codes := make(map[string]struct{})
+
+	var resume copyCheckpoint
+	if opts.Checkpoint != "" {
+		var err error
+		if resume, err = readCheckpoint(opts.Checkpoint); err != nil {
+			return report, err
+		}
+		if resume.Position > 0 && resume.CopyID != opts.CopyID {
+			return report, fmt.Errorf("checkpoint %s belongs to another copy %q", opts.Checkpoint, resume.CopyID)
+		}
+	}
+
+	batch := make([]storage.URL, 0, opts.BatchSize)
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		if err := copyBatch(ctx, to, batch, opts.DryRun, &report); err != nil {
+			return err
+		}
+		if opts.Checkpoint != "" && !opts.DryRun {
+			cp := copyCheckpoint{CopyID: opts.CopyID, Position: report.Read, ShortURL: batch[len(batch)-1].ShortURL}
+			if err := writeCheckpoint(opts.Checkpoint, cp); err != nil {
+				return err
+			}
+		}
+		if opts.Progress != nil {
+			opts.Progress(report)
+		}
+		batch = batch[:0]
+		return nil
+	}
+
+	err := from.ForEach(ctx, func(u storage.URL) error {
+		report.Read++
+		report.Source.add(u, now)
+		codes[u.ShortURL] = struct{}{}
+		if report.Read <= resume.Position {
+			if report.Read == resume.Position && u.ShortURL != resume.ShortURL {
+				return fmt.Errorf("source changed since checkpoint %s: expected %q at position %d, got %q",
+					opts.Checkpoint, resume.ShortURL, resume.Position, u.ShortURL)
+			}
+			report.Resumed++
+			return nil
+		}
+		batch = append(batch, u)
+		if len(batch) == opts.BatchSize {
+			return flush()
+		}
+		return nil
+	})
+	if err == nil {
+		err = flush()
+	}
+	if err != nil {
+		return report, err
+	}
+	if report.Read < resume.Position {
+		return report, fmt.Errorf("source changed since checkpoint %s: it has only %d links", opts.Checkpoint, report.Read)
+	}
+	if opts.DryRun {
+		return report, nil
+	}
+
+	if report.Destination, err = storageDigest(ctx, to, now, codes); err != nil {
+		return report, err
+	}
+	if report.Destination != report.Source {
+		return report, fmt.Errorf("%w: source has %s, destination has %s", ErrCopyMismatch, report.Source, report.Destination)
+	}
+	if opts.Checkpoint != "" {
+		if err := os.Remove(opts.Checkpoint); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return report, err
+		}
+	}
+	return report, nil
+}
+
+// copyBatch переносит пакет ссылок одним BatchSave. Если какой-то код пакета
+// в приёмнике уже занят, пакет переносится по одной ссылке, чтобы отличить
+// уже перенесённые ссылки от конфликтующих.
+func copyBatch(ctx context.Context, to Storage, batch []storage.URL, dryRun bool, report *CopyReport) error {
+	if !dryRun {
+		results, err := to.BatchSave(ctx, batch)
+		if err == nil {
+			for i, res := range results {
+				report.count(batch[i], res.ShortURL, res.Existing)
+			}
+			return nil
+		}
+		if !errors.Is(err, storage.ErrCodeTaken) {
+			return err
+		}
+	}
+
+	for _, u := range batch {
+		if err := copyOne(ctx, to, u, dryRun, report); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func copyOne(ctx context.Context, to Storage, u storage.URL, dryRun bool, report *CopyReport) error {
+	existing, err := to.Get(ctx, u.ShortURL)
+	switch {
+	case err == nil && existing.OriginalURL == u.OriginalURL:
+		report.Present++
+		return nil
+	case err == nil:
+		report.conflict(u, fmt.Sprintf("code is taken by %s", existing.OriginalURL))
+		return nil
+	case !errors.Is(err, storage.ErrNotFound):
+		return err
+	}
+
+	if dryRun {
+		key, err := to.GetByOriginalURL(ctx, u.OriginalURL)
+		switch {
+		case err == nil:
+			report.count(u, key, true)
+		case errors.Is(err, storage.ErrNotFound):
+			report.Copied++
+		default:
+			return err
+		}
+		return nil
+	}
+
+	key, err := to.Save(ctx, u)
+	var conflict *storage.ConflictError
+	switch {
+	case errors.As(err, &conflict):
+		report.count(u, conflict.ShortURL, true)
+	case err != nil:
+		return err
+	default:
+		report.count(u, key, false)
+	}
+	return nil
+}
+
+// count учитывает результат сохранения ссылки u под кодом key.
+func (r *CopyReport) count(u storage.URL, key string, existing bool) {
+	switch {
+	case key != u.ShortURL:
+		r.conflict(u, fmt.Sprintf("URL is already shortened as %s", key))
+	case existing:
+		r.Present++
+	default:
+		r.Copied++
+	}
+}
+
+func (r *CopyReport) conflict(u storage.URL, reason string) {
+	r.Conflicts = append(r.Conflicts, CopyConflict{ShortURL: u.ShortURL, OriginalURL: u.OriginalURL, Reason: reason})
+}
+
+func readCheckpoint(path string) (copyCheckpoint, error) {
+	var cp copyCheckpoint
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return cp, nil
+	}
+	if err != nil {
+		return cp, err
+	}
+	if err := json.Unmarshal(data, &cp); err != nil {
+		return cp, fmt.Errorf("invalid checkpoint %s: %w", path, err)
+	}
+	return cp, nil
+}
+
+func writeCheckpoint(path string, cp copyCheckpoint) error {
+	data, err := json.Marshal(cp)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(path, data)
+}
@@ -0,0 +1,259 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/vvityuk/shortener/internal/config"
+	appstorage "github.com/vvityuk/shortener/internal/storage"
+)
+
+// failingStorage отказывает в записи после limit сохранённых пакетов.
+type failingStorage struct {
+	Storage
+	limit int
+}
+
+func (s *failingStorage) BatchSave(ctx context.Context, items []appstorage.URL) ([]appstorage.SaveResult, error) {
+	if s.limit == 0 {
+		return nil, appstorage.ErrUnavailable
+	}
+	s.limit--
+	return s.Storage.BatchSave(ctx, items)
+}
+
+func TestCopyURLs(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	source, err := NewStorage(filepath.Join(dir, "urls.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer source.Close()
+
+	created := time.Now().Add(-time.Hour)
+	const n = 25
+	for i := 0; i < n; i++ {
+		u := appstorage.URL{
+			ShortURL:    fmt.Sprintf("k%02d", i),
+			OriginalURL: fmt.Sprintf("https://example.com/%d", i),
+			UserID:      "alice",
+			CreatedAt:   created.Add(time.Duration(i) * time.Second),
+		}
+		if i%5 == 0 {
+			u.ExpiresAt = created.Add(time.Minute)
+		}
+		if _, err := source.Save(ctx, u); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := source.DeleteURLs(ctx, []appstorage.DeleteRequest{{UserID: "alice", ShortURL: "k01"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("Dry run", func(t *testing.T) {
+		destination := NewMemoryStorage()
+		report, err := CopyURLs(ctx, source, destination, CopyOptions{DryRun: true, BatchSize: 10})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if report.Copied != n || report.Source.Count != n {
+			t.Errorf("Expected %d links to copy, got %+v", n, report)
+		}
+		if d, _ := StorageDigest(ctx, destination); d.Count != 0 {
+			t.Errorf("Expected dry run not to write, got %d links", d.Count)
+		}
+	})
+
+	t.Run("Resume", func(t *testing.T) {
+		checkpoint := filepath.Join(dir, "checkpoint")
+		destination := NewMemoryStorage()
+		opts := CopyOptions{BatchSize: 10, Checkpoint: checkpoint}
+
+		_, err := CopyURLs(ctx, source, &failingStorage{Storage: destination, limit: 1}, opts)
+		if !errors.Is(err, appstorage.ErrUnavailable) {
+			t.Fatalf("Expected interrupted copy, got %v", err)
+		}
+
+		report, err := CopyURLs(ctx, source, destination, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if report.Resumed != 10 || report.Copied != n-10 || len(report.Conflicts) != 0 {
+			t.Errorf("Expected copy to resume after the first batch, got %+v", report)
+		}
+		if report.Destination != report.Source {
+			t.Errorf("Expected equal digests, got %s and %s", report.Source, report.Destination)
+		}
+		if _, err := os.Stat(checkpoint); !errors.Is(err, os.ErrNotExist) {
+			t.Errorf("Expected checkpoint to be removed after verification, got %v", err)
+		}
+
+		u, err := destination.Get(ctx, "k01")
+		if err != nil || !u.Deleted || u.UserID != "alice" || !u.CreatedAt.Equal(created.Add(time.Second)) {
+			t.Errorf("Expected link metadata to be preserved, got %+v (err: %v)", u, err)
+		}
+
+		// Повторное копирование ничего не меняет
+		report, err = CopyURLs(ctx, source, destination, CopyOptions{BatchSize: 10})
+		if err != nil || report.Present != n || report.Copied != 0 {
+			t.Errorf("Expected all links to be present, got %+v (err: %v)", report, err)
+		}
+	})
+
+	t.Run("Non-empty destination", func(t *testing.T) {
+		destination := NewMemoryStorage()
+		if _, err := destination.Save(ctx, appstorage.URL{ShortURL: "other", OriginalURL: "https://other.example.com"}); err != nil {
+			t.Fatal(err)
+		}
+
+		// Чужие ссылки приёмника не участвуют в сверке
+		report, err := CopyURLs(ctx, source, destination, CopyOptions{BatchSize: 10})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if report.Copied != n || report.Destination != report.Source {
+			t.Errorf("Expected all links to be copied and verified, got %+v", report)
+		}
+	})
+
+	t.Run("Conflicts", func(t *testing.T) {
+		destination := NewMemoryStorage()
+		for _, u := range []appstorage.URL{
+			{ShortURL: "k02", OriginalURL: "https://other.example.com"},
+			{ShortURL: "other", OriginalURL: "https://example.com/3"},
+		} {
+			if _, err := destination.Save(ctx, u); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		report, err := CopyURLs(ctx, source, destination, CopyOptions{BatchSize: 10})
+		if !errors.Is(err, ErrCopyMismatch) {
+			t.Errorf("Expected verification to fail, got %v", err)
+		}
+		if len(report.Conflicts) != 2 || report.Conflicts[0].ShortURL != "k02" || report.Conflicts[1].ShortURL != "k03" {
+			t.Errorf("Expected conflicts for k02 and k03, got %+v", report.Conflicts)
+		}
+		if report.Copied != n-2 {
+			t.Errorf("Expected the rest to be copied, got %d", report.Copied)
+		}
+	})
+}
+
+func TestCopyURLsReshortened(t *testing.T) {
+	ctx := context.Background()
+	source, err := NewStorage(filepath.Join(t.TempDir(), "urls.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer source.Close()
+
+	// База Postgres общая для запусков, поэтому коды и URL каждый раз новые
+	suffix := fmt.Sprint(time.Now().UnixNano())
+	deleted := "https://example.com/deleted/" + suffix
+	expired := "https://example.com/expired/" + suffix
+	for _, u := range []appstorage.URL{
+		{ShortURL: "d1" + suffix, OriginalURL: deleted, UserID: "alice"},
+		{ShortURL: "e1" + suffix, OriginalURL: expired, ExpiresAt: time.Now().Add(-time.Minute)},
+	} {
+		if _, err := source.Save(ctx, u); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := source.DeleteURLs(ctx, []appstorage.DeleteRequest{{UserID: "alice", ShortURL: "d1" + suffix}}); err != nil {
+		t.Fatal(err)
+	}
+	for _, u := range []appstorage.URL{
+		{ShortURL: "d2" + suffix, OriginalURL: deleted},
+		{ShortURL: "e2" + suffix, OriginalURL: expired},
+	} {
+		if _, err := source.Save(ctx, u); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for name, destination := range testStorages(t) {
+		t.Run(name, func(t *testing.T) {
+			report, err := CopyURLs(ctx, source, destination, CopyOptions{BatchSize: 10})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if report.Copied != 4 || len(report.Conflicts) != 0 {
+				t.Errorf("Expected all 4 links to be copied, got %+v", report)
+			}
+			for _, tt := range []struct{ gone, live, original string }{
+				{"d1", "d2", deleted},
+				{"e1", "e2", expired},
+			} {
+				if u, err := destination.Get(ctx, tt.gone+suffix); err != nil || !u.Gone(time.Now()) {
+					t.Errorf("Expected %s to stay gone, got %+v (err: %v)", tt.gone, u, err)
+				}
+				if key, err := destination.GetByOriginalURL(ctx, tt.original); err != nil || key != tt.live+suffix {
+					t.Errorf("Expected %s to map to %s, got %q (err: %v)", tt.original, tt.live, key, err)
+				}
+			}
+		})
+	}
+}
+
+func TestCopyURLsReadOnlySource(t *testing.T) {
+	ctx := context.Background()
+	line := `{"short_url":"abcd","original_url":"https://ya.ru"}` + "\n"
+	tests := []struct {
+		name    string
+		journal string
+	}{
+		{"Legacy snapshot", `{"abcd":"https://ya.ru"}`},
+		// Длинный журнал сжимался бы, а недописанная строка обрезалась бы
+		{"Journal to compact", strings.Repeat(line, compactMinRecords*2) + `{"short_url":"ef`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			path := filepath.Join(dir, "urls.json")
+			if err := os.WriteFile(path, []byte(tt.journal), 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			source, err := OpenStorageURIReadOnly("file:"+path, &config.Config{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, dryRun := range []bool{true, false} {
+				report, err := CopyURLs(ctx, source, NewMemoryStorage(), CopyOptions{DryRun: dryRun})
+				if err != nil || report.Copied != 1 {
+					t.Errorf("Expected 1 link to be copied (dry run: %v), got %+v (err: %v)", dryRun, report, err)
+				}
+			}
+			if _, err := source.Save(ctx, appstorage.URL{ShortURL: "new", OriginalURL: "https://go.dev"}); !errors.Is(err, appstorage.ErrReadOnly) {
+				t.Errorf("Expected ErrReadOnly, got %v", err)
+			}
+			if err := source.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			if data, _ := os.ReadFile(path); string(data) != tt.journal {
+				t.Error("Expected source journal to stay unchanged")
+			}
+			entries, _ := os.ReadDir(dir)
+			if len(entries) != 1 {
+				t.Errorf("Expected no files next to the source, got %d entries", len(entries))
+			}
+		})
+	}
+
+	missing := filepath.Join(t.TempDir(), "missing.json")
+	if _, err := OpenStorageURIReadOnly("file:"+missing, &config.Config{}); err == nil {
+		t.Error("Expected missing source to fail")
+	}
+	if _, err := os.Stat(missing); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("Expected missing source not to be created, got %v", err)
+	}
+}
@@ -0,0 +1,53 @@
+package app
+
+import (
+	"context"
+	"time"
+
+	"github.com/vvityuk/shortener/internal/storage"
+	"go.uber.org/zap"
+)
+
+const (
+	// deleteBatchSize — сколько запросов на удаление копится до записи в хранилище.
+	deleteBatchSize = 500
+	// deleteFlushInterval — как долго неполный пакет ждёт записи.
+	deleteFlushInterval = time.Second
+	// deleteQueueSize — ёмкость очереди запросов от обработчиков.
+	deleteQueueSize = 1024
+)
+
+// deleter передаёт запросы на удаление хранилищу пакетами, чтобы каждое
+// обращение к хранилищу удаляло сразу много ссылок.
+type deleter struct {
+	storage Storage
+	logger  *zap.Logger
+	batcher *batcher[storage.DeleteRequest]
+}
+
+func newDeleter(store Storage, logger *zap.Logger) *deleter {
+	d := &deleter{storage: store, logger: logger}
+	d.batcher = newBatcher(deleteBatchSize, deleteFlushInterval, deleteQueueSize, d.flush)
+	return d
+}
+
+// enqueue ставит запросы в очередь. Если очередь заполнена, вызов ждёт
+// освобождения места.
+func (d *deleter) enqueue(items []storage.DeleteRequest) error {
+	return d.batcher.put(items)
+}
+
+// close перестаёт принимать запросы и ждёт, пока все уже поставленные
+// в очередь будут записаны в хранилище.
+func (d *deleter) close() {
+	d.batcher.close()
+}
+
+func (d *deleter) flush(batch []storage.DeleteRequest) {
+	if len(batch) == 0 {
+		return
+	}
+	if err := d.storage.DeleteURLs(context.Background(), batch); err != nil {
+		d.logger.Error("failed to delete links", zap.Int("count", len(batch)), zap.Error(err))
+	}
+}
@@ -0,0 +1,68 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/vvityuk/shortener/internal/config"
+	"github.com/vvityuk/shortener/internal/storage"
+	"go.uber.org/zap"
+)
+
+func TestDeleteUserURLs(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "urls.json")
+	fileStorage, err := NewStorage(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	service, err := newService(fileStorage, &config.Config{}, zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, u := range []storage.URL{
+		{ShortURL: "mine", OriginalURL: "https://mine.example.com", UserID: "alice"},
+		{ShortURL: "theirs", OriginalURL: "https://theirs.example.com", UserID: "bob"},
+	} {
+		if _, err := service.CreateURL(context.Background(), u.OriginalURL, CreateOptions{Alias: u.ShortURL, UserID: u.UserID}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := service.DeleteUserURLs("alice", []string{"mine", "theirs", "missing"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Close должен дождаться обработки очереди
+	if err := service.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := service.DeleteUserURLs("alice", []string{"mine"}); !errors.Is(err, ErrShuttingDown) {
+		t.Errorf("Expected ErrShuttingDown after Close, got %v", err)
+	}
+
+	fileStorage, err = NewStorage(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fileStorage.Close()
+
+	if u, err := fileStorage.Get(context.Background(), "mine"); err != nil || !u.Gone(time.Now()) {
+		t.Errorf("Expected mine to be deleted, got %+v", u)
+	}
+	if u, err := fileStorage.Get(context.Background(), "theirs"); err != nil || u.Gone(time.Now()) {
+		t.Errorf("Expected someone else's link to stay, got %+v", u)
+	}
+	if urls, _ := fileStorage.GetUserURLs(context.Background(), "alice"); len(urls) != 0 {
+		t.Errorf("Expected deleted links to be hidden from the owner, got %v", urls)
+	}
+
+	// Удалённый URL можно сократить заново
+	key, err := fileStorage.Save(context.Background(), storage.URL{ShortURL: "again", OriginalURL: "https://mine.example.com"})
+	if err != nil || key != "again" {
+		t.Errorf("Expected a new link for a deleted URL, got %q (err: %v)", key, err)
+	}
+}
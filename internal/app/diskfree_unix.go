@@ -0,0 +1,15 @@
+//go:build linux || darwin || freebsd
+
+package app
+
+import "syscall"
+
+// diskFree возвращает число байт, доступных непривилегированному
+// пользователю на файловой системе каталога dir.
+func diskFree(dir string) (uint64, error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(dir, &st); err != nil {
+		return 0, err
+	}
+	return uint64(st.Bavail) * uint64(st.Bsize), nil
+}
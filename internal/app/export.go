@@ -0,0 +1,52 @@
+package app
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/vvityuk/shortener/internal/export"
+)
+
+// ExportURLs выгружает все ссылки в формате из параметра format: csv или
+// ndjson (по умолчанию). Ссылки пишутся в ответ по мере обхода хранилища.
+// Если обход прервался после начала передачи, соединение разрывается,
+// чтобы клиент не принял неполную выгрузку за целую.
+func (h *Handler) ExportURLs(w http.ResponseWriter, r *http.Request) {
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = export.FormatNDJSON
+	}
+	body := &trackingWriter{w: w}
+	ew, err := export.NewWriter(body, format)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	w.Header().Set("Content-Type", export.ContentType(format))
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="urls.%s"`, format))
+
+	err = h.service.ForEachURL(r.Context(), ew.Write)
+	if err == nil {
+		err = ew.Flush()
+	}
+	if err != nil {
+		if body.written {
+			panic(http.ErrAbortHandler)
+		}
+		w.Header().Del("Content-Disposition")
+		writeError(w, err)
+	}
+}
+
+// trackingWriter запоминает, было ли что-то записано в ответ.
+type trackingWriter struct {
+	w       io.Writer
+	written bool
+}
+
+func (t *trackingWriter) Write(p []byte) (int, error) {
+	t.written = true
+	return t.w.Write(p)
+}
@@ -0,0 +1,78 @@
+package app
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/vvityuk/shortener/internal/app/middleware"
+	"github.com/vvityuk/shortener/internal/config"
+	"go.uber.org/zap"
+)
+
+func TestExportURLs(t *testing.T) {
+	service, err := newService(NewMemoryStorage(), &config.Config{}, zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer service.Close()
+	for _, u := range []string{"https://one.example.com", "https://two.example.com"} {
+		if _, err := service.CreateURL(context.Background(), u, CreateOptions{UserID: "alice"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	handler := middleware.AdminOnly("secret")(http.HandlerFunc(NewHandler(service).ExportURLs))
+
+	tests := []struct {
+		name          string
+		query         string
+		authorization string
+		status        int
+		contentType   string
+		lines         int
+	}{
+		{"No token", "", "", http.StatusUnauthorized, "", 0},
+		{"Wrong token", "", "Bearer wrong", http.StatusForbidden, "", 0},
+		{"NDJSON by default", "", "Bearer secret", http.StatusOK, "application/x-ndjson", 2},
+		{"CSV", "?format=csv", "Bearer secret", http.StatusOK, "text/csv; charset=utf-8", 3},
+		{"Unknown format", "?format=xml", "Bearer secret", http.StatusBadRequest, "application/json", 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/api/admin/export"+tt.query, nil)
+			if tt.authorization != "" {
+				req.Header.Set("Authorization", tt.authorization)
+			}
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, req)
+
+			if w.Code != tt.status {
+				t.Fatalf("Expected status %d, got %d", tt.status, w.Code)
+			}
+			if tt.contentType == "" {
+				return
+			}
+			if ct := w.Header().Get("Content-Type"); ct != tt.contentType {
+				t.Errorf("Expected Content-Type %q, got %q", tt.contentType, ct)
+			}
+			if lines := strings.Count(w.Body.String(), "\n"); lines != tt.lines {
+				t.Errorf("Expected %d lines, got %d: %s", tt.lines, lines, w.Body.String())
+			}
+			if tt.status == http.StatusOK && !strings.Contains(w.Body.String(), "alice") {
+				t.Errorf("Expected owner in export, got %s", w.Body.String())
+			}
+		})
+	}
+
+	t.Run("Not configured", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodGet, "/api/admin/export", nil)
+		req.Header.Set("Authorization", "Bearer anything")
+		w := httptest.NewRecorder()
+		middleware.AdminOnly("")(http.HandlerFunc(NewHandler(service).ExportURLs)).ServeHTTP(w, req)
+		if w.Code != http.StatusForbidden {
+			t.Errorf("Expected status %d, got %d", http.StatusForbidden, w.Code)
+		}
+	})
+}
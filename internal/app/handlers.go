@@ -1,19 +1,35 @@
 package app
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"io"
 	"net/http"
+	"strings"
+	"time"
 
 	"github.com/go-chi/chi/v5"
+	"github.com/vvityuk/shortener/internal/app/middleware"
+	"github.com/vvityuk/shortener/internal/storage"
 )
 
 type Handler struct {
 	service *Service
 }
 
+// expiration — необязательный срок действия ссылки: либо момент
+// истечения, либо время жизни в секундах.
+type expiration struct {
+	ExpiresAt  *time.Time `json:"expires_at,omitempty"`
+	TTLSeconds int64      `json:"ttl_seconds,omitempty"`
+}
+
 type shortenRequest struct {
-	URL string `json:"url"`
+	URL   string `json:"url"`
+	Alias string `json:"alias,omitempty"`
+	expiration
 }
 
 type shortenResponse struct {
@@ -23,11 +39,118 @@ type shortenResponse struct {
 type batchRequest struct {
 	CorrelationID string `json:"correlation_id"`
 	OriginalURL   string `json:"original_url"`
+	Alias         string `json:"alias,omitempty"`
+	expiration
 }
 
 type batchResponse struct {
-	CorrelationID string `json:"correlation_id"`
-	ShortURL      string `json:"short_url"`
+	CorrelationID string      `json:"correlation_id"`
+	ShortURL      string      `json:"short_url,omitempty"`
+	Status        BatchStatus `json:"status"`
+	Error         *batchError `json:"error,omitempty"`
+}
+
+// batchError — причина отклонения элемента пакета. Code предназначен
+// для программной обработки, Message — для человека.
+type batchError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// Коды ошибок элементов пакета.
+const (
+	batchErrMissingCorrelationID   = "missing_correlation_id"
+	batchErrDuplicateCorrelationID = "duplicate_correlation_id"
+	batchErrInvalidExpiration      = "invalid_expiration"
+	batchErrInvalidURL             = "invalid_url"
+	batchErrInvalidAlias           = "invalid_alias"
+	batchErrAliasTaken             = "alias_taken"
+	batchErrInvalid                = "invalid"
+)
+
+// batchSummary — ответ на пакет в режиме Prefer: return=minimal.
+type batchSummary struct {
+	Created  int             `json:"created"`
+	Existing int             `json:"existing"`
+	Invalid  int             `json:"invalid"`
+	Errors   []batchResponse `json:"errors"`
+}
+
+// add учитывает результат элемента в счётчиках.
+func (s *batchSummary) add(item batchResponse) {
+	switch item.Status {
+	case BatchCreated:
+		s.Created++
+	case BatchExisting:
+		s.Existing++
+	case BatchInvalid:
+		s.Invalid++
+	}
+}
+
+type userURLResponse struct {
+	ShortURL    string `json:"short_url"`
+	OriginalURL string `json:"original_url"`
+}
+
+type errorResponse struct {
+	Error string `json:"error"`
+}
+
+// expiresAt вычисляет момент истечения ссылки относительно now.
+// Нулевое время означает бессрочную ссылку.
+func (e expiration) expiresAt(now time.Time) (time.Time, error) {
+	switch {
+	case e.ExpiresAt != nil && e.TTLSeconds != 0:
+		return time.Time{}, errors.New("expires_at and ttl_seconds are mutually exclusive")
+	case e.ExpiresAt != nil:
+		if !e.ExpiresAt.After(now) {
+			return time.Time{}, errors.New("expires_at must be in the future")
+		}
+		return *e.ExpiresAt, nil
+	case e.TTLSeconds < 0:
+		return time.Time{}, errors.New("ttl_seconds must be positive")
+	case e.TTLSeconds > 0:
+		return now.Add(time.Duration(e.TTLSeconds) * time.Second), nil
+	}
+	return time.Time{}, nil
+}
+
+// reject помечает элемент пакета отклонённым.
+func (b *batchResponse) reject(code, message string) {
+	b.Status = BatchInvalid
+	b.ShortURL = ""
+	b.Error = &batchError{Code: code, Message: message}
+}
+
+// batchErrorCode возвращает код ошибки элемента пакета для err.
+func batchErrorCode(err error) string {
+	switch {
+	case errors.Is(err, ErrInvalidURL):
+		return batchErrInvalidURL
+	case errors.Is(err, ErrInvalidAlias):
+		return batchErrInvalidAlias
+	case errors.Is(err, ErrAliasTaken):
+		return batchErrAliasTaken
+	default:
+		return batchErrInvalid
+	}
+}
+
+// preferMinimal сообщает, просит ли клиент минимальный ответ (RFC 7240).
+func preferMinimal(r *http.Request) bool {
+	for _, header := range r.Header.Values("Prefer") {
+		for _, pref := range strings.Split(header, ",") {
+			// Параметры предпочтения после ";" не важны
+			pref, _, _ = strings.Cut(pref, ";")
+			name, value, _ := strings.Cut(strings.TrimSpace(pref), "=")
+			if strings.EqualFold(strings.TrimSpace(name), "return") &&
+				strings.EqualFold(strings.Trim(strings.TrimSpace(value), `"`), "minimal") {
+				return true
+			}
+		}
+	}
+	return false
 }
 
 func NewHandler(service *Service) *Handler {
@@ -38,26 +161,115 @@ func NewHandler(service *Service) *Handler {
 
 func (h *Handler) GetURL(w http.ResponseWriter, r *http.Request) {
 	shortCode := chi.URLParam(r, "shortCode")
-	val, ok := h.service.GetURL(shortCode)
-	if ok {
-		w.Header().Set("Location", val)
-		w.WriteHeader(http.StatusTemporaryRedirect)
+	u, err := h.service.GetURL(r.Context(), shortCode)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	h.service.RecordClick(storage.Click{
+		ShortURL:  shortCode,
+		At:        time.Now(),
+		Referrer:  clickField(r.Referer()),
+		UserAgent: clickField(r.UserAgent()),
+		IP:        anonymizeIP(r.RemoteAddr),
+	})
+	w.Header().Set("Location", u.OriginalURL)
+	w.WriteHeader(http.StatusTemporaryRedirect)
+}
+
+// maxClickFieldSize — предельная длина сохраняемых Referer и User-Agent.
+const maxClickFieldSize = 512
+
+// clickField обрезает значение заголовка до maxClickFieldSize и убирает
+// невалидный UTF-8, который не примет текстовая колонка базы.
+func clickField(value string) string {
+	if len(value) > maxClickFieldSize {
+		value = value[:maxClickFieldSize]
+	}
+	return strings.ToValidUTF8(value, "")
+}
+
+type statsBucketResponse struct {
+	Start  time.Time `json:"start"`
+	Clicks int       `json:"clicks"`
+}
+
+type statsResponse struct {
+	ShortURL       string                `json:"short_url"`
+	TotalClicks    int                   `json:"total_clicks"`
+	UniqueVisitors int                   `json:"unique_visitors"`
+	Bucket         string                `json:"bucket"`
+	Series         []statsBucketResponse `json:"series"`
+}
+
+// URLStats возвращает статистику переходов по ссылке. Параметры запроса:
+// bucket — hour или day (по умолчанию), from и to — границы ряда в RFC 3339.
+// По умолчанию ряд охватывает последние сутки по часам или последние
+// 30 дней по дням.
+func (h *Handler) URLStats(w http.ResponseWriter, r *http.Request) {
+	shortCode := chi.URLParam(r, "shortCode")
+	query := r.URL.Query()
+
+	q := storage.StatsQuery{Bucket: query.Get("bucket"), To: time.Now()}
+	if q.Bucket == "" {
+		q.Bucket = storage.BucketDay
+	}
+	if q.Bucket == storage.BucketHour {
+		q.From = q.To.Add(-24 * time.Hour)
+	} else {
+		q.From = q.To.AddDate(0, 0, -30)
+	}
+	for name, dst := range map[string]*time.Time{"from": &q.From, "to": &q.To} {
+		value := query.Get(name)
+		if value == "" {
+			continue
+		}
+		t, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("%s must be an RFC 3339 timestamp", name))
+			return
+		}
+		*dst = t
+	}
+
+	stats, err := h.service.ClickStats(r.Context(), shortCode, q)
+	if err != nil {
+		writeError(w, err)
 		return
 	}
-	w.WriteHeader(http.StatusBadRequest)
+
+	resp := statsResponse{
+		ShortURL:       h.service.config.BaseURL + "/" + shortCode,
+		TotalClicks:    stats.Total,
+		UniqueVisitors: stats.Unique,
+		Bucket:         q.Bucket,
+		Series:         make([]statsBucketResponse, 0, len(stats.Series)),
+	}
+	for _, b := range stats.Series {
+		resp.Series = append(resp.Series, statsBucketResponse{Start: b.Start, Clicks: b.Clicks})
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
 }
 
 func (h *Handler) CreateURL(w http.ResponseWriter, r *http.Request) {
 	defer r.Body.Close()
 
-	myurl, _ := io.ReadAll(r.Body)
-	shortURL, isNew, err := h.service.CreateURL(string(myurl))
+	myurl, err := io.ReadAll(r.Body)
 	if err != nil {
-		http.Error(w, "Failed to create short URL", http.StatusInternalServerError)
+		if !bodyReadFailed(w, err) {
+			writeJSONError(w, http.StatusBadRequest, "failed to read request body")
+		}
+		return
+	}
+	userID, _ := middleware.UserID(r.Context())
+	shortURL, err := h.service.CreateURL(r.Context(), string(myurl), CreateOptions{UserID: userID})
+	if err != nil && !errors.Is(err, storage.ErrConflict) {
+		writeError(w, err)
 		return
 	}
 
-	if !isNew {
+	if err != nil {
 		w.WriteHeader(http.StatusConflict)
 	} else {
 		w.WriteHeader(http.StatusCreated)
@@ -70,6 +282,9 @@ func (h *Handler) ShortenURL(w http.ResponseWriter, r *http.Request) {
 
 	var req shortenRequest
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		if bodyReadFailed(w, err) {
+			return
+		}
 		http.Error(w, "Invalid request body", http.StatusBadRequest)
 		return
 	}
@@ -79,9 +294,16 @@ func (h *Handler) ShortenURL(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	shortURL, isNew, err := h.service.CreateURL(req.URL)
+	expiresAt, err := req.expiresAt(time.Now())
 	if err != nil {
-		http.Error(w, "Failed to create short URL", http.StatusInternalServerError)
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	userID, _ := middleware.UserID(r.Context())
+	shortURL, err := h.service.CreateURL(r.Context(), req.URL, CreateOptions{Alias: req.Alias, ExpiresAt: expiresAt, UserID: userID})
+	if err != nil && !errors.Is(err, storage.ErrConflict) {
+		writeError(w, err)
 		return
 	}
 
@@ -90,7 +312,7 @@ func (h *Handler) ShortenURL(w http.ResponseWriter, r *http.Request) {
 	}
 
 	w.Header().Set("Content-Type", "application/json")
-	if !isNew {
+	if err != nil {
 		w.WriteHeader(http.StatusConflict)
 	} else {
 		w.WriteHeader(http.StatusCreated)
@@ -106,11 +328,17 @@ func (h *Handler) PingDB(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(http.StatusOK)
 }
 
+// BatchShortenURL сокращает пакет URL. Ответ содержит результат для каждого
+// элемента запроса в том же порядке. С заголовком Prefer: return=minimal
+// вместо результатов возвращается сводка и только отклонённые элементы.
 func (h *Handler) BatchShortenURL(w http.ResponseWriter, r *http.Request) {
 	defer r.Body.Close()
 
 	var req []batchRequest
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		if bodyReadFailed(w, err) {
+			return
+		}
 		http.Error(w, "Invalid request body", http.StatusBadRequest)
 		return
 	}
@@ -119,31 +347,216 @@ func (h *Handler) BatchShortenURL(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Empty batch", http.StatusBadRequest)
 		return
 	}
+	if h.batchTooLarge(w, len(req)) {
+		return
+	}
 
-	items := make(map[string]string)
-	for _, item := range req {
-		if item.OriginalURL == "" {
-			http.Error(w, "URL is required", http.StatusBadRequest)
-			return
+	resp := make([]batchResponse, len(req))
+	seen := make(map[string]bool, len(req))
+	for i, item := range req {
+		resp[i].CorrelationID = item.CorrelationID
+		if item.CorrelationID == "" {
+			resp[i].reject(batchErrMissingCorrelationID, "correlation_id is required")
+			continue
+		}
+		if seen[item.CorrelationID] {
+			resp[i].reject(batchErrDuplicateCorrelationID, fmt.Sprintf("correlation_id %q is repeated in the batch", item.CorrelationID))
+			continue
+		}
+		seen[item.CorrelationID] = true
+	}
+
+	if err := h.shortenBatch(r.Context(), req, resp); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	// 201, если создана хотя бы одна ссылка, иначе 200
+	status := http.StatusOK
+	for _, item := range resp {
+		if item.Status == BatchCreated {
+			status = http.StatusCreated
+			break
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Add("Vary", "Prefer")
+	if !preferMinimal(r) {
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(resp)
+		return
+	}
+
+	summary := batchSummary{Errors: make([]batchResponse, 0)}
+	for _, item := range resp {
+		summary.add(item)
+		if item.Status == BatchInvalid {
+			summary.Errors = append(summary.Errors, item)
 		}
-		items[item.CorrelationID] = item.OriginalURL
 	}
+	w.Header().Set("Preference-Applied", "return=minimal")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(summary)
+}
 
-	result, err := h.service.BatchCreateURL(items)
+// shortenBatch сокращает элементы req и заполняет ответы resp с теми же
+// индексами. Элементы, уже отклонённые в resp, пропускаются.
+func (h *Handler) shortenBatch(ctx context.Context, req []batchRequest, resp []batchResponse) error {
+	now := time.Now()
+	userID, _ := middleware.UserID(ctx)
+	items := make([]BatchItem, 0, len(req))
+	positions := make([]int, 0, len(req)) // positions[j] — индекс в req для items[j]
+	for i, item := range req {
+		if resp[i].Status == BatchInvalid {
+			continue
+		}
+		expiresAt, err := item.expiresAt(now)
+		if err != nil {
+			resp[i].reject(batchErrInvalidExpiration, err.Error())
+			continue
+		}
+		items = append(items, BatchItem{
+			OriginalURL:   item.OriginalURL,
+			CreateOptions: CreateOptions{Alias: item.Alias, ExpiresAt: expiresAt, UserID: userID},
+		})
+		positions = append(positions, i)
+	}
+
+	results, err := h.service.BatchCreateURL(ctx, items)
 	if err != nil {
-		http.Error(w, "Failed to create short URLs", http.StatusInternalServerError)
+		return err
+	}
+	for j, result := range results {
+		item := &resp[positions[j]]
+		if result.Status == BatchInvalid {
+			item.reject(batchErrorCode(result.Err), result.Err.Error())
+			continue
+		}
+		item.Status = result.Status
+		item.ShortURL = h.service.config.BaseURL + "/" + result.ShortURL
+	}
+	return nil
+}
+
+// GetUserURLs возвращает ссылки, созданные текущим пользователем.
+func (h *Handler) GetUserURLs(w http.ResponseWriter, r *http.Request) {
+	userID, authenticated := middleware.UserID(r.Context())
+	if !authenticated {
+		writeJSONError(w, http.StatusUnauthorized, "valid auth cookie is required")
 		return
 	}
 
-	resp := make([]batchResponse, 0, len(result))
-	for correlationID, shortURL := range result {
-		resp = append(resp, batchResponse{
-			CorrelationID: correlationID,
-			ShortURL:      h.service.config.BaseURL + "/" + shortURL,
+	urls, err := h.service.GetUserURLs(r.Context(), userID)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	if len(urls) == 0 {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	resp := make([]userURLResponse, 0, len(urls))
+	for _, u := range urls {
+		resp = append(resp, userURLResponse{
+			ShortURL:    h.service.config.BaseURL + "/" + u.ShortURL,
+			OriginalURL: u.OriginalURL,
 		})
 	}
 
 	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusCreated)
+	w.WriteHeader(http.StatusOK)
 	json.NewEncoder(w).Encode(resp)
 }
+
+// DeleteUserURLs принимает список коротких кодов текущего пользователя
+// и удаляет их в фоне.
+func (h *Handler) DeleteUserURLs(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+
+	userID, authenticated := middleware.UserID(r.Context())
+	if !authenticated {
+		writeJSONError(w, http.StatusUnauthorized, "valid auth cookie is required")
+		return
+	}
+
+	var codes []string
+	if err := json.NewDecoder(r.Body).Decode(&codes); err != nil {
+		if bodyReadFailed(w, err) {
+			return
+		}
+		writeJSONError(w, http.StatusBadRequest, "request body must be a JSON array of short codes")
+		return
+	}
+	if h.batchTooLarge(w, len(codes)) {
+		return
+	}
+
+	if err := h.service.DeleteUserURLs(userID, codes); err != nil {
+		writeError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// bodyReadFailed отвечает на ошибку чтения тела запроса, если чтение
+// прервано лимитом размера или повреждённым сжатием. Иначе ответ остаётся
+// за обработчиком.
+func bodyReadFailed(w http.ResponseWriter, err error) bool {
+	var maxErr *http.MaxBytesError
+	if !errors.As(err, &maxErr) && !errors.Is(err, middleware.ErrMalformedBody) {
+		return false
+	}
+	writeError(w, err)
+	return true
+}
+
+// batchTooLarge отвечает 413, если пакет длиннее MaxBatchSize.
+// Нулевой MaxBatchSize снимает ограничение.
+func (h *Handler) batchTooLarge(w http.ResponseWriter, n int) bool {
+	limit := h.service.config.MaxBatchSize
+	if limit <= 0 || n <= limit {
+		return false
+	}
+	writeJSONError(w, http.StatusRequestEntityTooLarge, fmt.Sprintf("batch exceeds %d items", limit))
+	return true
+}
+
+// writeError отвечает JSON-ошибкой со статусом, соответствующим err.
+func writeError(w http.ResponseWriter, err error) {
+	status, message := errorStatus(err)
+	writeJSONError(w, status, message)
+}
+
+// errorStatus возвращает HTTP-статус и сообщение для клиента, соответствующие
+// err. Подробности внутренних ошибок клиенту не передаются.
+func errorStatus(err error) (int, string) {
+	var maxErr *http.MaxBytesError
+	switch {
+	case errors.As(err, &maxErr):
+		return http.StatusRequestEntityTooLarge, fmt.Sprintf("request body exceeds %d bytes", maxErr.Limit)
+	case errors.Is(err, middleware.ErrMalformedBody):
+		return http.StatusBadRequest, err.Error()
+	case errors.Is(err, ErrInvalidAlias), errors.Is(err, ErrInvalidURL), errors.Is(err, ErrInvalidStatsQuery):
+		return http.StatusBadRequest, err.Error()
+	case errors.Is(err, storage.ErrNotFound):
+		return http.StatusNotFound, err.Error()
+	case errors.Is(err, ErrAliasTaken), errors.Is(err, storage.ErrConflict):
+		return http.StatusConflict, err.Error()
+	case errors.Is(err, storage.ErrGone):
+		return http.StatusGone, err.Error()
+	case errors.Is(err, storage.ErrUnavailable):
+		return http.StatusServiceUnavailable, storage.ErrUnavailable.Error()
+	case errors.Is(err, ErrShuttingDown):
+		return http.StatusServiceUnavailable, err.Error()
+	default:
+		return http.StatusInternalServerError, "internal server error"
+	}
+}
+
+func writeJSONError(w http.ResponseWriter, status int, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(errorResponse{Error: message})
+}
@@ -2,16 +2,22 @@ package app
 
 import (
 	"bytes"
+	"compress/gzip"
 	"context"
 	"encoding/json"
+	"fmt"
 	"net/http"
 	"net/http/httptest"
 	"os"
 	"strings"
 	"testing"
+	"time"
 
-	"github.com/go-chi/chi"
+	"github.com/go-chi/chi/v5"
+	"github.com/vvityuk/shortener/internal/app/middleware"
 	"github.com/vvityuk/shortener/internal/config"
+	"github.com/vvityuk/shortener/internal/storage"
+	"go.uber.org/zap"
 )
 
 func TestHandlers(t *testing.T) {
@@ -25,12 +31,13 @@ func TestHandlers(t *testing.T) {
 
 	// Создаем конфигурацию
 	cfg := &config.Config{
+		StorageBackend:  config.StorageBackendFile,
 		FileStoragePath: tmpFile.Name(),
 		BaseURL:         "http://localhost:8080",
 	}
 
 	// Создаем сервис и обработчик
-	service, err := NewService(cfg)
+	service, err := NewService(cfg, zap.NewNop())
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -67,8 +74,8 @@ func TestHandlers(t *testing.T) {
 
 		handler.GetURL(w, req)
 
-		if w.Code != http.StatusBadRequest {
-			t.Errorf("Expected status %d, got %d", http.StatusBadRequest, w.Code)
+		if w.Code != http.StatusNotFound {
+			t.Errorf("Expected status %d, got %d", http.StatusNotFound, w.Code)
 		}
 	})
 
@@ -100,6 +107,152 @@ func TestHandlers(t *testing.T) {
 		}
 	})
 
+	// Тест создания URL с пользовательским кодом
+	t.Run("Create URL with alias", func(t *testing.T) {
+		tests := []struct {
+			name   string
+			req    shortenRequest
+			status int
+		}{
+			{"new alias", shortenRequest{URL: "https://alias.example.com", Alias: "my-link"}, http.StatusCreated},
+			{"taken alias", shortenRequest{URL: "https://other.example.com", Alias: "my-link"}, http.StatusConflict},
+			{"reserved alias", shortenRequest{URL: "https://other.example.com", Alias: "PING"}, http.StatusBadRequest},
+			{"invalid characters", shortenRequest{URL: "https://other.example.com", Alias: "my/link"}, http.StatusBadRequest},
+			{"too short", shortenRequest{URL: "https://other.example.com", Alias: "ab"}, http.StatusBadRequest},
+		}
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				body, _ := json.Marshal(tt.req)
+				request := httptest.NewRequest(http.MethodPost, "/api/shorten", bytes.NewReader(body))
+				w := httptest.NewRecorder()
+
+				handler.ShortenURL(w, request)
+
+				if w.Code != tt.status {
+					t.Fatalf("Expected status %d, got %d", tt.status, w.Code)
+				}
+				if tt.status == http.StatusCreated {
+					var response shortenResponse
+					if err := json.NewDecoder(w.Body).Decode(&response); err != nil {
+						t.Fatal(err)
+					}
+					if response.Result != cfg.BaseURL+"/"+tt.req.Alias {
+						t.Errorf("Expected %s, got %s", cfg.BaseURL+"/"+tt.req.Alias, response.Result)
+					}
+					return
+				}
+				var response errorResponse
+				if err := json.NewDecoder(w.Body).Decode(&response); err != nil || response.Error == "" {
+					t.Errorf("Expected JSON error, got %q", w.Body.String())
+				}
+			})
+		}
+	})
+
+	// Тест истечения ссылки
+	t.Run("Expired URL", func(t *testing.T) {
+		body, _ := json.Marshal(shortenRequest{URL: "https://expiring.example.com", Alias: "expiring", expiration: expiration{TTLSeconds: 1}})
+		request := httptest.NewRequest(http.MethodPost, "/api/shorten", bytes.NewReader(body))
+		w := httptest.NewRecorder()
+		handler.ShortenURL(w, request)
+		if w.Code != http.StatusCreated {
+			t.Fatalf("Expected status %d, got %d", http.StatusCreated, w.Code)
+		}
+
+		get := func() int {
+			req := httptest.NewRequest(http.MethodGet, "/expiring", nil)
+			rctx := chi.NewRouteContext()
+			rctx.URLParams.Add("shortCode", "expiring")
+			req = req.WithContext(context.WithValue(req.Context(), chi.RouteCtxKey, rctx))
+			w := httptest.NewRecorder()
+			handler.GetURL(w, req)
+			return w.Code
+		}
+
+		if code := get(); code != http.StatusTemporaryRedirect {
+			t.Errorf("Expected status %d, got %d", http.StatusTemporaryRedirect, code)
+		}
+		time.Sleep(1100 * time.Millisecond)
+		if code := get(); code != http.StatusGone {
+			t.Errorf("Expected status %d, got %d", http.StatusGone, code)
+		}
+	})
+
+	// Тест некорректного срока действия
+	t.Run("Invalid expiration", func(t *testing.T) {
+		past := time.Now().Add(-time.Hour)
+		for _, exp := range []expiration{{TTLSeconds: -1}, {ExpiresAt: &past}, {ExpiresAt: &past, TTLSeconds: 10}} {
+			body, _ := json.Marshal(shortenRequest{URL: "https://invalid-ttl.example.com", expiration: exp})
+			request := httptest.NewRequest(http.MethodPost, "/api/shorten", bytes.NewReader(body))
+			w := httptest.NewRecorder()
+			handler.ShortenURL(w, request)
+			if w.Code != http.StatusBadRequest {
+				t.Errorf("Expected status %d, got %d", http.StatusBadRequest, w.Code)
+			}
+		}
+	})
+
+	// Тест получения ссылок пользователя
+	t.Run("User URLs", func(t *testing.T) {
+		auth := middleware.Auth([]byte("secret"))
+		create := auth(http.HandlerFunc(handler.ShortenURL))
+		list := auth(http.HandlerFunc(handler.GetUserURLs))
+
+		// Без cookie пользователь не аутентифицирован
+		w := httptest.NewRecorder()
+		list.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/user/urls", nil))
+		if w.Code != http.StatusUnauthorized {
+			t.Fatalf("Expected status %d, got %d", http.StatusUnauthorized, w.Code)
+		}
+		cookies := w.Result().Cookies()
+		if len(cookies) != 1 || cookies[0].Name != middleware.AuthCookieName {
+			t.Fatalf("Expected auth cookie to be issued, got %v", cookies)
+		}
+		cookie := cookies[0]
+
+		// Новому пользователю нечего показать
+		req := httptest.NewRequest(http.MethodGet, "/api/user/urls", nil)
+		req.AddCookie(cookie)
+		w = httptest.NewRecorder()
+		list.ServeHTTP(w, req)
+		if w.Code != http.StatusNoContent {
+			t.Fatalf("Expected status %d, got %d", http.StatusNoContent, w.Code)
+		}
+
+		body, _ := json.Marshal(shortenRequest{URL: "https://user.example.com"})
+		req = httptest.NewRequest(http.MethodPost, "/api/shorten", bytes.NewReader(body))
+		req.AddCookie(cookie)
+		w = httptest.NewRecorder()
+		create.ServeHTTP(w, req)
+		if w.Code != http.StatusCreated {
+			t.Fatalf("Expected status %d, got %d", http.StatusCreated, w.Code)
+		}
+
+		req = httptest.NewRequest(http.MethodGet, "/api/user/urls", nil)
+		req.AddCookie(cookie)
+		w = httptest.NewRecorder()
+		list.ServeHTTP(w, req)
+		if w.Code != http.StatusOK {
+			t.Fatalf("Expected status %d, got %d", http.StatusOK, w.Code)
+		}
+		var response []userURLResponse
+		if err := json.NewDecoder(w.Body).Decode(&response); err != nil {
+			t.Fatal(err)
+		}
+		if len(response) != 1 || response[0].OriginalURL != "https://user.example.com" {
+			t.Errorf("Expected the created URL, got %v", response)
+		}
+
+		// Подделанная подпись не принимается
+		req = httptest.NewRequest(http.MethodGet, "/api/user/urls", nil)
+		req.AddCookie(&http.Cookie{Name: middleware.AuthCookieName, Value: cookie.Value + "0"})
+		w = httptest.NewRecorder()
+		list.ServeHTTP(w, req)
+		if w.Code != http.StatusUnauthorized {
+			t.Errorf("Expected status %d, got %d", http.StatusUnauthorized, w.Code)
+		}
+	})
+
 	// Тест проверки подключения к БД
 	t.Run("Ping DB", func(t *testing.T) {
 		req := httptest.NewRequest(http.MethodGet, "/ping", nil)
@@ -146,6 +299,150 @@ func TestHandlers(t *testing.T) {
 		}
 	})
 
+	// Тест пакетного создания URL с занятым пользовательским кодом
+	t.Run("Batch Shorten URL Alias Taken", func(t *testing.T) {
+		batchReq := []batchRequest{
+			{CorrelationID: "1", OriginalURL: "https://batch-alias1.example.com", Alias: "batch-alias"},
+			{CorrelationID: "2", OriginalURL: "https://batch-alias2.example.com", Alias: "batch-alias"},
+		}
+		body, _ := json.Marshal(batchReq)
+
+		req := httptest.NewRequest(http.MethodPost, "/api/shorten/batch", bytes.NewReader(body))
+		w := httptest.NewRecorder()
+
+		handler.BatchShortenURL(w, req)
+
+		if w.Code != http.StatusCreated {
+			t.Errorf("Expected status %d, got %d", http.StatusCreated, w.Code)
+		}
+
+		// Код достаётся первому элементу, второй отклоняется
+		var response []batchResponse
+		if err := json.NewDecoder(w.Body).Decode(&response); err != nil {
+			t.Fatal(err)
+		}
+		if len(response) != 2 || response[0].Status != BatchCreated || response[1].Status != BatchInvalid {
+			t.Fatalf("Expected the first item created and the second invalid, got %+v", response)
+		}
+		if response[1].Error == nil || response[1].Error.Code != batchErrAliasTaken || response[1].ShortURL != "" {
+			t.Errorf("Expected alias_taken error without a short URL, got %+v", response[1])
+		}
+	})
+
+	// Тест дедупликации URL в пакете
+	t.Run("Batch Shorten URL Dedup", func(t *testing.T) {
+		batchReq := []batchRequest{
+			{CorrelationID: "known", OriginalURL: "https://ya.ru"},
+			{CorrelationID: "new", OriginalURL: "https://dedup.example.com"},
+			{CorrelationID: "repeat", OriginalURL: "https://dedup.example.com"},
+			{CorrelationID: "empty", OriginalURL: ""},
+			{CorrelationID: "ttl", OriginalURL: "https://ttl.example.com", expiration: expiration{TTLSeconds: -1}},
+		}
+		body, _ := json.Marshal(batchReq)
+
+		w := httptest.NewRecorder()
+		handler.BatchShortenURL(w, httptest.NewRequest(http.MethodPost, "/api/shorten/batch", bytes.NewReader(body)))
+		if w.Code != http.StatusCreated {
+			t.Errorf("Expected status %d, got %d", http.StatusCreated, w.Code)
+		}
+
+		var response []batchResponse
+		if err := json.NewDecoder(w.Body).Decode(&response); err != nil {
+			t.Fatal(err)
+		}
+		expected := []struct {
+			id     string
+			status BatchStatus
+			code   string
+		}{
+			{"known", BatchExisting, ""},
+			{"new", BatchCreated, ""},
+			{"repeat", BatchExisting, ""},
+			{"empty", BatchInvalid, batchErrInvalidURL},
+			{"ttl", BatchInvalid, batchErrInvalidExpiration},
+		}
+		if len(response) != len(expected) {
+			t.Fatalf("Expected %d responses, got %d", len(expected), len(response))
+		}
+		for i, e := range expected {
+			resp := response[i]
+			if resp.CorrelationID != e.id || resp.Status != e.status {
+				t.Errorf("Expected item %d to be %s/%s, got %+v", i, e.id, e.status, resp)
+			}
+			if e.code != "" && (resp.Error == nil || resp.Error.Code != e.code) {
+				t.Errorf("Expected item %d to fail with %s, got %+v", i, e.code, resp.Error)
+			}
+		}
+		if response[1].ShortURL != response[2].ShortURL {
+			t.Errorf("Expected repeated URL to get the same short URL, got %q and %q", response[1].ShortURL, response[2].ShortURL)
+		}
+
+		// Повторный пакет из известных URL ничего не создаёт
+		w = httptest.NewRecorder()
+		handler.BatchShortenURL(w, httptest.NewRequest(http.MethodPost, "/api/shorten/batch", bytes.NewReader(body)))
+		if w.Code != http.StatusOK {
+			t.Errorf("Expected status %d, got %d", http.StatusOK, w.Code)
+		}
+	})
+
+	// Тест пустых и повторяющихся correlation_id
+	t.Run("Batch Shorten URL Correlation IDs", func(t *testing.T) {
+		batchReq := []batchRequest{
+			{CorrelationID: "a", OriginalURL: "https://ids1.example.com"},
+			{CorrelationID: "", OriginalURL: "https://ids2.example.com"},
+			{CorrelationID: "a", OriginalURL: "https://ids3.example.com"},
+		}
+		body, _ := json.Marshal(batchReq)
+
+		w := httptest.NewRecorder()
+		handler.BatchShortenURL(w, httptest.NewRequest(http.MethodPost, "/api/shorten/batch", bytes.NewReader(body)))
+
+		var response []batchResponse
+		if err := json.NewDecoder(w.Body).Decode(&response); err != nil {
+			t.Fatal(err)
+		}
+		if len(response) != 3 {
+			t.Fatalf("Expected 3 responses, got %d", len(response))
+		}
+		if response[0].Status != BatchCreated {
+			t.Errorf("Expected the first item to be created, got %+v", response[0])
+		}
+		for i, code := range map[int]string{1: batchErrMissingCorrelationID, 2: batchErrDuplicateCorrelationID} {
+			if response[i].Status != BatchInvalid || response[i].Error == nil || response[i].Error.Code != code {
+				t.Errorf("Expected item %d to fail with %s, got %+v", i, code, response[i])
+			}
+		}
+	})
+
+	// Тест минимального ответа на пакет
+	t.Run("Batch Shorten URL Prefer Minimal", func(t *testing.T) {
+		batchReq := []batchRequest{
+			{CorrelationID: "1", OriginalURL: "https://minimal.example.com"},
+			{CorrelationID: "2", OriginalURL: "https://ya.ru"},
+			{CorrelationID: "3", OriginalURL: ""},
+		}
+		body, _ := json.Marshal(batchReq)
+
+		req := httptest.NewRequest(http.MethodPost, "/api/shorten/batch", bytes.NewReader(body))
+		req.Header.Set("Prefer", "respond-async, return=minimal")
+		w := httptest.NewRecorder()
+		handler.BatchShortenURL(w, req)
+
+		if w.Code != http.StatusCreated {
+			t.Errorf("Expected status %d, got %d", http.StatusCreated, w.Code)
+		}
+		if applied := w.Header().Get("Preference-Applied"); applied != "return=minimal" {
+			t.Errorf("Expected Preference-Applied return=minimal, got %q", applied)
+		}
+		var summary batchSummary
+		if err := json.NewDecoder(w.Body).Decode(&summary); err != nil {
+			t.Fatal(err)
+		}
+		if summary.Created != 1 || summary.Existing != 1 || summary.Invalid != 1 || len(summary.Errors) != 1 || summary.Errors[0].CorrelationID != "3" {
+			t.Errorf("Unexpected summary %+v", summary)
+		}
+	})
+
 	// Тест пакетного создания URL с пустым запросом
 	t.Run("Batch Shorten URL Empty Request", func(t *testing.T) {
 		req := httptest.NewRequest(http.MethodPost, "/api/shorten/batch", bytes.NewReader([]byte("[]")))
@@ -172,3 +469,208 @@ func TestHandlers(t *testing.T) {
 		}
 	})
 }
+
+// unavailableStorage имитирует недоступную базу данных.
+type unavailableStorage struct {
+	*MemoryStorage
+}
+
+var errConnRefused = fmt.Errorf("%w: connection refused", storage.ErrUnavailable)
+
+func (s unavailableStorage) Get(context.Context, string) (storage.URL, error) {
+	return storage.URL{}, errConnRefused
+}
+
+func (s unavailableStorage) Save(context.Context, storage.URL) (string, error) {
+	return "", errConnRefused
+}
+
+func (s unavailableStorage) BatchSave(context.Context, []storage.URL) ([]storage.SaveResult, error) {
+	return nil, errConnRefused
+}
+
+func TestHandlersStorageUnavailable(t *testing.T) {
+	service, err := newService(unavailableStorage{NewMemoryStorage()}, &config.Config{BaseURL: "http://localhost:8080"}, zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer service.Close()
+	handler := NewHandler(service)
+
+	// Недоступность хранилища не должна выглядеть как отсутствие ссылки
+	req := httptest.NewRequest(http.MethodGet, "/abcd", nil)
+	rctx := chi.NewRouteContext()
+	rctx.URLParams.Add("shortCode", "abcd")
+	req = req.WithContext(context.WithValue(req.Context(), chi.RouteCtxKey, rctx))
+	w := httptest.NewRecorder()
+	handler.GetURL(w, req)
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected status %d, got %d", http.StatusServiceUnavailable, w.Code)
+	}
+
+	body, _ := json.Marshal(shortenRequest{URL: "https://ya.ru"})
+	w = httptest.NewRecorder()
+	handler.ShortenURL(w, httptest.NewRequest(http.MethodPost, "/api/shorten", bytes.NewReader(body)))
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected status %d, got %d", http.StatusServiceUnavailable, w.Code)
+	}
+	var resp errorResponse
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil || strings.Contains(resp.Error, "connection refused") {
+		t.Errorf("Expected a generic error message, got %q (err: %v)", resp.Error, err)
+	}
+}
+
+func TestRequestLimits(t *testing.T) {
+	service, err := newService(NewMemoryStorage(), &config.Config{BaseURL: "http://localhost:8080", MaxBatchSize: 2}, zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer service.Close()
+	handler := NewHandler(service)
+
+	r := chi.NewRouter()
+	r.Use(middleware.DecompressRequest(middleware.BodyLimits{MaxSize: 1 << 10, MaxDecompressedSize: 4 << 10}))
+	r.Post("/", handler.CreateURL)
+	r.Post("/api/shorten/batch", handler.BatchShortenURL)
+
+	compress := func(data []byte) []byte {
+		var buf bytes.Buffer
+		gz := gzip.NewWriter(&buf)
+		gz.Write(data)
+		gz.Close()
+		return buf.Bytes()
+	}
+	truncated := compress([]byte("https://ya.ru"))
+	truncated = truncated[:len(truncated)-4]
+
+	tests := []struct {
+		name     string
+		path     string
+		body     []byte
+		encoding string
+		status   int
+	}{
+		{"decompression bomb", "/", compress(make([]byte, 64<<10)), "gzip", http.StatusRequestEntityTooLarge},
+		{"oversized body", "/", bytes.Repeat([]byte("a"), 2<<10), "", http.StatusRequestEntityTooLarge},
+		{"truncated gzip", "/", truncated, "gzip", http.StatusBadRequest},
+		{"batch too large", "/api/shorten/batch", []byte(`[
+			{"correlation_id":"1","original_url":"https://ya.ru"},
+			{"correlation_id":"2","original_url":"https://go.dev"},
+			{"correlation_id":"3","original_url":"https://example.com"}]`), "", http.StatusRequestEntityTooLarge},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, tt.path, bytes.NewReader(tt.body))
+			if tt.encoding != "" {
+				req.Header.Set("Content-Encoding", tt.encoding)
+			}
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, req)
+			if w.Code != tt.status {
+				t.Errorf("Expected status %d, got %d", tt.status, w.Code)
+			}
+			var resp errorResponse
+			if err := json.NewDecoder(w.Body).Decode(&resp); err != nil || resp.Error == "" {
+				t.Errorf("Expected JSON error, got %q (err: %v)", resp.Error, err)
+			}
+		})
+	}
+}
+
+func TestHandlersGoneAfterReshorten(t *testing.T) {
+	for name, raw := range testStorages(t) {
+		t.Run(name, func(t *testing.T) {
+			service, err := newService(raw, &config.Config{BaseURL: "http://localhost:8080"}, zap.NewNop())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer service.Close()
+			handler := NewHandler(service)
+			r := chi.NewRouter()
+			r.Get("/{shortCode}", handler.GetURL)
+
+			// База Postgres общая для запусков, поэтому URL каждый раз новые
+			suffix := fmt.Sprint(time.Now().UnixNano())
+			deleted := "https://example.com/deleted/" + suffix
+			expired := "https://example.com/expired/" + suffix
+
+			ctx := context.Background()
+			deletedCode, err := service.CreateURL(ctx, deleted, CreateOptions{UserID: "user1"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := raw.DeleteURLs(ctx, []storage.DeleteRequest{{UserID: "user1", ShortURL: deletedCode}}); err != nil {
+				t.Fatal(err)
+			}
+			expiredCode, err := service.CreateURL(ctx, expired, CreateOptions{ExpiresAt: time.Now().Add(-time.Minute)})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			for old, original := range map[string]string{deletedCode: deleted, expiredCode: expired} {
+				code, err := service.CreateURL(ctx, original, CreateOptions{})
+				if err != nil {
+					t.Fatalf("Expected %s to be shortened again, got %v", original, err)
+				}
+				if code == old {
+					t.Fatalf("Expected a new code for %s, got the old one", original)
+				}
+
+				w := httptest.NewRecorder()
+				r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/"+old, nil))
+				if w.Code != http.StatusGone {
+					t.Errorf("Expected old code of %s to answer %d, got %d", original, http.StatusGone, w.Code)
+				}
+				w = httptest.NewRecorder()
+				r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/"+code, nil))
+				if w.Code != http.StatusTemporaryRedirect || w.Header().Get("Location") != original {
+					t.Errorf("Expected new code to redirect to %s, got %d %q", original, w.Code, w.Header().Get("Location"))
+				}
+			}
+		})
+	}
+}
+
+func TestHandlersGoneAfterSweep(t *testing.T) {
+	for name, raw := range testStorages(t) {
+		t.Run(name, func(t *testing.T) {
+			cfg := &config.Config{BaseURL: "http://localhost:8080", ExpiredSweepInterval: 10 * time.Millisecond, ExpiredRetention: time.Hour}
+			service, err := newService(raw, cfg, zap.NewNop())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer service.Close()
+			handler := NewHandler(service)
+			r := chi.NewRouter()
+			r.Get("/{shortCode}", handler.GetURL)
+
+			suffix := fmt.Sprint(time.Now().UnixNano())
+			ctx := context.Background()
+			recent, err := service.CreateURL(ctx, "https://example.com/recent/"+suffix, CreateOptions{ExpiresAt: time.Now().Add(-time.Minute)})
+			if err != nil {
+				t.Fatal(err)
+			}
+			old, err := service.CreateURL(ctx, "https://example.com/old/"+suffix, CreateOptions{ExpiresAt: time.Now().Add(-2 * time.Hour)})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			status := func(code string) int {
+				w := httptest.NewRecorder()
+				r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/"+code, nil))
+				return w.Code
+			}
+			// Ссылка, истёкшая раньше срока хранения, удаляется очисткой
+			deadline := time.Now().Add(5 * time.Second)
+			for status(old) != http.StatusNotFound {
+				if time.Now().After(deadline) {
+					t.Fatal("Expected the sweep to purge a link expired beyond retention")
+				}
+				time.Sleep(10 * time.Millisecond)
+			}
+			if got := status(recent); got != http.StatusGone {
+				t.Errorf("Expected recently expired link to answer %d after sweep, got %d", http.StatusGone, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,188 @@
+package app
+
+import (
+	"sort"
+	"time"
+
+	"github.com/vvityuk/shortener/internal/storage"
+)
+
+// urlIndex — двунаправленный индекс ссылок: короткий код -> ссылка
+// и исходный URL -> короткий код. Обе стороны обновляются вместе, поэтому
+// поиск по исходному URL выполняется за O(1). Индекс не потокобезопасен,
+// блокировки обеспечивает владеющее им хранилище.
+type urlIndex struct {
+	urls   map[string]storage.URL         // короткий код -> ссылка
+	codes  map[string]string              // исходный URL -> короткий код
+	owners map[string]map[string]struct{} // пользователь -> его короткие коды
+}
+
+func newURLIndex() *urlIndex {
+	return &urlIndex{
+		urls:   make(map[string]storage.URL),
+		codes:  make(map[string]string),
+		owners: make(map[string]map[string]struct{}),
+	}
+}
+
+func (idx *urlIndex) get(key string) (storage.URL, bool) {
+	u, ok := idx.urls[key]
+	return u, ok
+}
+
+// liveKeyOf возвращает код действующей (не истёкшей и не удалённой) ссылки на value.
+func (idx *urlIndex) liveKeyOf(value string, now time.Time) (string, bool) {
+	key, ok := idx.codes[value]
+	if !ok || idx.urls[key].Gone(now) {
+		return "", false
+	}
+	return key, true
+}
+
+// put сохраняет ссылку. Если код уже указывал на другой URL, обратная запись
+// старого URL удаляется. Обратный индекс указывает на последний сохранённый
+// код URL — так истёкшую ссылку можно заменить новой до того, как её удалит
+// очистка, — но недействующая ссылка не вытесняет действующую: иначе
+// при загрузке журнала удалённая запись скрыла бы живую ссылку на тот же URL.
+func (idx *urlIndex) put(u storage.URL) {
+	idx.remove(u.ShortURL)
+	idx.urls[u.ShortURL] = u
+	now := time.Now()
+	if _, live := idx.liveKeyOf(u.OriginalURL, now); !live || !u.Gone(now) {
+		idx.codes[u.OriginalURL] = u.ShortURL
+	}
+	if u.UserID != "" {
+		keys, ok := idx.owners[u.UserID]
+		if !ok {
+			keys = make(map[string]struct{})
+			idx.owners[u.UserID] = keys
+		}
+		keys[u.ShortURL] = struct{}{}
+	}
+}
+
+// remove удаляет ссылку с кодом key вместе с её обратной записью.
+func (idx *urlIndex) remove(key string) {
+	old, ok := idx.urls[key]
+	if !ok {
+		return
+	}
+	if idx.codes[old.OriginalURL] == key {
+		delete(idx.codes, old.OriginalURL)
+	}
+	if keys, ok := idx.owners[old.UserID]; ok {
+		delete(keys, key)
+		if len(keys) == 0 {
+			delete(idx.owners, old.UserID)
+		}
+	}
+	delete(idx.urls, key)
+}
+
+// byUser возвращает действующие ссылки пользователя userID.
+func (idx *urlIndex) byUser(userID string, now time.Time) []storage.URL {
+	keys := idx.owners[userID]
+	urls := make([]storage.URL, 0, len(keys))
+	for key := range keys {
+		if u := idx.urls[key]; !u.Gone(now) {
+			urls = append(urls, u)
+		}
+	}
+	return urls
+}
+
+// deletable возвращает ссылки из items, принадлежащие указанным в запросах
+// пользователям и ещё не удалённые, уже помеченными как удалённые.
+func (idx *urlIndex) deletable(items []storage.DeleteRequest) []storage.URL {
+	var urls []storage.URL
+	seen := make(map[string]bool, len(items))
+	for _, item := range items {
+		u, ok := idx.urls[item.ShortURL]
+		if !ok || u.Deleted || u.UserID != item.UserID || seen[u.ShortURL] {
+			continue
+		}
+		seen[u.ShortURL] = true
+		u.Deleted = true
+		urls = append(urls, u)
+	}
+	return urls
+}
+
+// expired возвращает коды ссылок, срок действия которых истёк к now.
+func (idx *urlIndex) expired(now time.Time) []string {
+	var keys []string
+	for key, u := range idx.urls {
+		if u.Expired(now) {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+// checkFree возвращает storage.ErrCodeTaken, если хотя бы один из кодов
+// пакета уже занят или повторяется внутри пакета.
+func (idx *urlIndex) checkFree(items []storage.URL) error {
+	seen := make(map[string]struct{}, len(items))
+	for _, u := range items {
+		if _, ok := idx.urls[u.ShortURL]; ok {
+			return storage.ErrCodeTaken
+		}
+		if _, ok := seen[u.ShortURL]; ok {
+			return storage.ErrCodeTaken
+		}
+		seen[u.ShortURL] = struct{}{}
+	}
+	return nil
+}
+
+// batch разбирает пакет ссылок: URL, у которых уже есть действующая ссылка
+// или которые повторяются в пакете, получают существующий код, остальные
+// возвращаются в fresh для сохранения. results[i] соответствует items[i].
+func (idx *urlIndex) batch(items []storage.URL, now time.Time) (results []storage.SaveResult, fresh []storage.URL, err error) {
+	results = make([]storage.SaveResult, len(items))
+	planned := make(map[string]string, len(items)) // исходный URL -> код в этом пакете
+	for i, u := range items {
+		if key, ok := idx.liveKeyOf(u.OriginalURL, now); ok {
+			results[i] = storage.SaveResult{ShortURL: key, Existing: true}
+			continue
+		}
+		if key, ok := planned[u.OriginalURL]; ok {
+			results[i] = storage.SaveResult{ShortURL: key, Existing: true}
+			continue
+		}
+		// Недействующая ссылка (например, перенесённая из другого хранилища
+		// удалённой) не занимает URL
+		if !u.Gone(now) {
+			planned[u.OriginalURL] = u.ShortURL
+		}
+		if u.CreatedAt.IsZero() {
+			u.CreatedAt = now
+		}
+		fresh = append(fresh, u)
+		results[i] = storage.SaveResult{ShortURL: u.ShortURL}
+	}
+	if err := idx.checkFree(fresh); err != nil {
+		return nil, nil, err
+	}
+	return results, fresh, nil
+}
+
+// keys возвращает коды всех ссылок в порядке создания.
+func (idx *urlIndex) keys() []string {
+	keys := make([]string, 0, len(idx.urls))
+	for key := range idx.urls {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		a, b := idx.urls[keys[i]], idx.urls[keys[j]]
+		if !a.CreatedAt.Equal(b.CreatedAt) {
+			return a.CreatedAt.Before(b.CreatedAt)
+		}
+		return a.ShortURL < b.ShortURL
+	})
+	return keys
+}
+
+func (idx *urlIndex) len() int {
+	return len(idx.urls)
+}
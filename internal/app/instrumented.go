@@ -0,0 +1,151 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/vvityuk/shortener/internal/metrics"
+	"github.com/vvityuk/shortener/internal/storage"
+	"github.com/vvityuk/shortener/internal/storage/postgres"
+)
+
+// instrumentedStorage измеряет длительность и считает ошибки каждой
+// операции хранилища в разрезе бэкенда и метода.
+type instrumentedStorage struct {
+	Storage
+	backend  string
+	duration *metrics.HistogramVec
+	errors   *metrics.CounterVec
+}
+
+func newInstrumentedStorage(s Storage, reg *metrics.Registry) *instrumentedStorage {
+	return &instrumentedStorage{
+		Storage:  s,
+		backend:  backendName(s),
+		duration: reg.NewHistogramVec("storage_operation_duration_seconds", "Storage operation latency by backend and method.", metrics.DefBuckets, "backend", "method"),
+		errors:   reg.NewCounterVec("storage_operation_errors_total", "Failed storage operations by backend and method.", "backend", "method"),
+	}
+}
+
+func backendName(s Storage) string {
+	switch s.(type) {
+	case *postgres.Storage:
+		return "postgres"
+	case *FileStorage:
+		return "file"
+	case *MemoryStorage:
+		return "memory"
+	default:
+		return "other"
+	}
+}
+
+// registerStorageGauges регистрирует датчики числа ссылок. Размер индекса
+// в памяти есть только у файлового хранилища и хранилища в памяти.
+func registerStorageGauges(reg *metrics.Registry, s Storage) {
+	reg.NewGaugeFunc("shortener_links", "Total stored links.", func(ctx context.Context) (float64, error) {
+		n, err := s.Count(ctx)
+		return float64(n), err
+	})
+	if idx, ok := s.(interface{ indexSize() int }); ok {
+		reg.NewGaugeFunc("shortener_memory_index_size", "Links held in the in-memory index.", func(context.Context) (float64, error) {
+			return float64(idx.indexSize()), nil
+		})
+	}
+}
+
+// observe учитывает операцию method, начатую в start. Ожидаемые исходы —
+// отсутствие ссылки, уже сокращённый URL и занятый код — ошибками
+// не считаются.
+func (s *instrumentedStorage) observe(method string, start time.Time, err error) {
+	s.duration.WithLabelValues(s.backend, method).Observe(time.Since(start).Seconds())
+	if err != nil && !errors.Is(err, storage.ErrNotFound) && !errors.Is(err, storage.ErrConflict) && !errors.Is(err, storage.ErrCodeTaken) {
+		s.errors.WithLabelValues(s.backend, method).Inc()
+	}
+}
+
+func (s *instrumentedStorage) Get(ctx context.Context, key string) (storage.URL, error) {
+	start := time.Now()
+	u, err := s.Storage.Get(ctx, key)
+	s.observe("Get", start, err)
+	return u, err
+}
+
+func (s *instrumentedStorage) Save(ctx context.Context, u storage.URL) (string, error) {
+	start := time.Now()
+	key, err := s.Storage.Save(ctx, u)
+	s.observe("Save", start, err)
+	return key, err
+}
+
+func (s *instrumentedStorage) GetByOriginalURL(ctx context.Context, originalURL string) (string, error) {
+	start := time.Now()
+	key, err := s.Storage.GetByOriginalURL(ctx, originalURL)
+	s.observe("GetByOriginalURL", start, err)
+	return key, err
+}
+
+func (s *instrumentedStorage) BatchSave(ctx context.Context, items []storage.URL) ([]storage.SaveResult, error) {
+	start := time.Now()
+	results, err := s.Storage.BatchSave(ctx, items)
+	s.observe("BatchSave", start, err)
+	return results, err
+}
+
+func (s *instrumentedStorage) GetUserURLs(ctx context.Context, userID string) ([]storage.URL, error) {
+	start := time.Now()
+	urls, err := s.Storage.GetUserURLs(ctx, userID)
+	s.observe("GetUserURLs", start, err)
+	return urls, err
+}
+
+func (s *instrumentedStorage) DeleteExpired(ctx context.Context, now time.Time) (int, error) {
+	start := time.Now()
+	n, err := s.Storage.DeleteExpired(ctx, now)
+	s.observe("DeleteExpired", start, err)
+	return n, err
+}
+
+func (s *instrumentedStorage) DeleteURLs(ctx context.Context, items []storage.DeleteRequest) error {
+	start := time.Now()
+	err := s.Storage.DeleteURLs(ctx, items)
+	s.observe("DeleteURLs", start, err)
+	return err
+}
+
+// ForEach измеряет весь обход, включая время работы fn.
+func (s *instrumentedStorage) ForEach(ctx context.Context, fn func(storage.URL) error) error {
+	start := time.Now()
+	err := s.Storage.ForEach(ctx, fn)
+	s.observe("ForEach", start, err)
+	return err
+}
+
+func (s *instrumentedStorage) Count(ctx context.Context) (int, error) {
+	start := time.Now()
+	n, err := s.Storage.Count(ctx)
+	s.observe("Count", start, err)
+	return n, err
+}
+
+func (s *instrumentedStorage) RecordClicks(ctx context.Context, clicks []storage.Click) error {
+	start := time.Now()
+	err := s.Storage.RecordClicks(ctx, clicks)
+	s.observe("RecordClicks", start, err)
+	return err
+}
+
+func (s *instrumentedStorage) ClickStats(ctx context.Context, shortURL string, q storage.StatsQuery) (storage.ClickStats, error) {
+	start := time.Now()
+	stats, err := s.Storage.ClickStats(ctx, shortURL, q)
+	s.observe("ClickStats", start, err)
+	return stats, err
+}
+
+func (s *instrumentedStorage) Ping(ctx context.Context) error {
+	start := time.Now()
+	err := s.Storage.Ping(ctx)
+	s.observe("Ping", start, err)
+	return err
+}
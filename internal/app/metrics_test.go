@@ -0,0 +1,59 @@
+package app
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/vvityuk/shortener/internal/app/middleware"
+	"github.com/vvityuk/shortener/internal/config"
+	"github.com/vvityuk/shortener/internal/golden"
+	"go.uber.org/zap"
+)
+
+func TestMetricsEndpoint(t *testing.T) {
+	service, err := newService(NewMemoryStorage(), &config.Config{BaseURL: "http://localhost:8080"}, zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer service.Close()
+	handler := NewHandler(service)
+
+	r := chi.NewRouter()
+	r.Use(middleware.Metrics(service.Metrics()))
+	r.Get("/{shortCode}", handler.GetURL)
+	r.Post("/", handler.CreateURL)
+	r.Get("/metrics", service.Metrics().ServeHTTP)
+
+	var code string
+	for i := 0; i < 2; i++ {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/", strings.NewReader("https://ya.ru")))
+		code = strings.TrimPrefix(w.Body.String(), "http://localhost:8080/")
+	}
+	for _, path := range []string{"/" + code, "/" + code, "/missing", "/no/such/route"} {
+		r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, path, nil))
+	}
+	// Дожидаемся записи переходов, чтобы она попала в метрики хранилища
+	service.clicks.close()
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if ct := w.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/plain; version=0.0.4") {
+		t.Errorf("Unexpected content type %q", ct)
+	}
+
+	// Корзины и суммы длительностей зависят от скорости машины, поэтому
+	// от гистограмм в сравнении остаётся только число наблюдений
+	var got bytes.Buffer
+	for _, line := range strings.SplitAfter(w.Body.String(), "\n") {
+		if strings.Contains(line, "_seconds_bucket{") || strings.Contains(line, "_seconds_sum{") {
+			continue
+		}
+		got.WriteString(line)
+	}
+	golden.Check(t, "metrics", got.Bytes())
+}
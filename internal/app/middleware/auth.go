@@ -0,0 +1,96 @@
+package middleware
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"strings"
+)
+
+// AuthCookieName — имя cookie с подписанным идентификатором пользователя.
+const AuthCookieName = "user_id"
+
+type authContextKey struct{}
+
+type authInfo struct {
+	userID string
+	issued bool // cookie выдана этим запросом, а не предъявлена клиентом
+}
+
+// Auth проверяет подпись cookie с идентификатором пользователя и кладёт
+// идентификатор в контекст запроса. Клиенту без cookie или с неверной
+// подписью выдаётся новый идентификатор.
+func Auth(secret []byte) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			info := authInfo{}
+			if cookie, err := r.Cookie(AuthCookieName); err == nil {
+				info.userID, _ = verify(cookie.Value, secret)
+			}
+
+			if info.userID == "" {
+				userID, err := newUserID()
+				if err != nil {
+					http.Error(w, "Failed to issue user ID", http.StatusInternalServerError)
+					return
+				}
+				info = authInfo{userID: userID, issued: true}
+				http.SetCookie(w, &http.Cookie{
+					Name:     AuthCookieName,
+					Value:    sign(userID, secret),
+					Path:     "/",
+					HttpOnly: true,
+					SameSite: http.SameSiteLaxMode,
+				})
+			}
+
+			ctx := context.WithValue(r.Context(), authContextKey{}, info)
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
+
+// UserID возвращает идентификатор пользователя из контекста запроса.
+// authenticated равен false, если клиент не предъявил действительную cookie
+// и идентификатор был выдан только что.
+func UserID(ctx context.Context) (userID string, authenticated bool) {
+	info, ok := ctx.Value(authContextKey{}).(authInfo)
+	if !ok {
+		return "", false
+	}
+	return info.userID, !info.issued
+}
+
+func newUserID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// sign возвращает значение cookie вида <userID>.<HMAC-SHA256 в hex>.
+func sign(userID string, secret []byte) string {
+	return userID + "." + hex.EncodeToString(mac(userID, secret))
+}
+
+func verify(value string, secret []byte) (string, bool) {
+	userID, signature, ok := strings.Cut(value, ".")
+	if !ok || userID == "" {
+		return "", false
+	}
+	got, err := hex.DecodeString(signature)
+	if err != nil || !hmac.Equal(got, mac(userID, secret)) {
+		return "", false
+	}
+	return userID, true
+}
+
+func mac(userID string, secret []byte) []byte {
+	h := hmac.New(sha256.New, secret)
+	h.Write([]byte(userID))
+	return h.Sum(nil)
+}
@@ -1,67 +1,377 @@
 package middleware
 
 import (
+	"compress/flate"
 	"compress/gzip"
+	"compress/zlib"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"io"
+	"mime"
 	"net/http"
+	"strconv"
 	"strings"
+	"sync"
+
+	"github.com/andybalholm/brotli"
 )
 
-type gzipWriter struct {
+// minCompressSize — ответы короче этого порога не сжимаются: выигрыш
+// меньше накладных расходов формата.
+const minCompressSize = 1024
+
+// encoder — общий интерфейс сжимающих писателей, которые можно
+// переиспользовать через Reset.
+type encoder interface {
+	io.WriteCloser
+	Flush() error
+	Reset(w io.Writer)
+}
+
+// encodings — поддерживаемые кодировки в порядке предпочтения сервера
+// при равных q-значениях у клиента.
+var encodings = []string{"br", "gzip", "deflate"}
+
+var encoderPools = map[string]*sync.Pool{
+	"br": {New: func() any {
+		// Уровень выше 4 заметно замедляет сжатие на лету
+		return brotli.NewWriterLevel(nil, 4)
+	}},
+	"gzip": {New: func() any {
+		gz, _ := gzip.NewWriterLevel(nil, gzip.BestSpeed)
+		return gz
+	}},
+	// В HTTP deflate означает поток zlib, а не «голый» deflate
+	"deflate": {New: func() any {
+		zw, _ := zlib.NewWriterLevel(nil, zlib.BestSpeed)
+		return zw
+	}},
+}
+
+// compressibleTypes — типы ответов, которые имеет смысл сжимать.
+var compressibleTypes = map[string]bool{
+	"application/json":       true,
+	"application/x-ndjson":   true,
+	"application/javascript": true,
+	"application/xml":        true,
+	"image/svg+xml":          true,
+}
+
+func compressible(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	return strings.HasPrefix(mediaType, "text/") ||
+		strings.HasSuffix(mediaType, "+json") ||
+		compressibleTypes[mediaType]
+}
+
+// negotiateEncoding выбирает кодировку по заголовку Accept-Encoding
+// с учётом q-значений. Пустая строка — сжимать нельзя.
+func negotiateEncoding(header string) string {
+	accepted := make(map[string]float64)
+	wildcard := -1.0
+	for _, part := range strings.Split(header, ",") {
+		name, params, _ := strings.Cut(part, ";")
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" {
+			continue
+		}
+		q := 1.0
+		for _, param := range strings.Split(params, ";") {
+			key, value, _ := strings.Cut(param, "=")
+			if strings.TrimSpace(strings.ToLower(key)) != "q" {
+				continue
+			}
+			v, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+			if err != nil || v < 0 || v > 1 {
+				v = 0
+			}
+			q = v
+		}
+		if name == "*" {
+			wildcard = q
+		} else {
+			accepted[name] = q
+		}
+	}
+
+	best, bestQ := "", 0.0
+	for _, enc := range encodings {
+		q, ok := accepted[enc]
+		if !ok {
+			q = wildcard
+		}
+		if q > bestQ {
+			best, bestQ = enc, q
+		}
+	}
+	return best
+}
+
+// compressWriter откладывает заголовки и начало тела, пока не станет
+// ясно, сжимать ли ответ: решение принимается по Content-Type, который
+// выставил обработчик, и по объёму тела.
+type compressWriter struct {
 	http.ResponseWriter
-	Writer io.Writer
+	encoding string
+
+	status  int
+	buf     []byte
+	decided bool
+	enc     encoder
 }
 
-func (w gzipWriter) Write(b []byte) (int, error) {
-	return w.Writer.Write(b)
+// WriteHeader запоминает статус до решения о сжатии. Повторные вызовы
+// игнорируются, как в net/http: статус уже выбран первым вызовом.
+func (w *compressWriter) WriteHeader(code int) {
+	if w.decided || w.status != 0 {
+		return
+	}
+	// Информационные ответы уходят сразу и не завершают ответ
+	if code >= 100 && code < 200 {
+		w.ResponseWriter.WriteHeader(code)
+		return
+	}
+	w.status = code
 }
 
-func CompressResponse(next http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		// Проверяем, что клиент поддерживает gzip
-		if !strings.Contains(r.Header.Get("Accept-Encoding"), "gzip") {
-			next.ServeHTTP(w, r)
-			return
+func (w *compressWriter) Write(b []byte) (int, error) {
+	if !w.decided {
+		w.buf = append(w.buf, b...)
+		if len(w.buf) < minCompressSize {
+			return len(b), nil
+		}
+		if err := w.decide(true); err != nil {
+			return 0, err
 		}
+		return len(b), nil
+	}
+	if w.enc != nil {
+		return w.enc.Write(b)
+	}
+	return w.ResponseWriter.Write(b)
+}
 
-		// Проверяем тип контента
-		contentType := r.Header.Get("Content-Type")
-		if !strings.Contains(contentType, "application/json") && !strings.Contains(contentType, "text/html") {
-			next.ServeHTTP(w, r)
+// decide отправляет заголовки и накопленное тело. bigEnough сообщает,
+// что ответ достаточно велик для сжатия.
+func (w *compressWriter) decide(bigEnough bool) error {
+	w.decided = true
+	h := w.Header()
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	if h.Get("Content-Type") == "" && len(w.buf) > 0 {
+		// Как net/http, но до того, как заголовки уйдут клиенту
+		h.Set("Content-Type", http.DetectContentType(w.buf))
+	}
+
+	if bigEnough && w.status != http.StatusNoContent && w.status != http.StatusNotModified &&
+		h.Get("Content-Encoding") == "" && compressible(h.Get("Content-Type")) {
+		h.Del("Content-Length")
+		h.Set("Content-Encoding", w.encoding)
+		w.enc = encoderPools[w.encoding].Get().(encoder)
+		w.enc.Reset(w.ResponseWriter)
+	}
+
+	w.ResponseWriter.WriteHeader(w.status)
+	buf := w.buf
+	w.buf = nil
+	if len(buf) == 0 {
+		return nil
+	}
+	var err error
+	if w.enc != nil {
+		_, err = w.enc.Write(buf)
+	} else {
+		_, err = w.ResponseWriter.Write(buf)
+	}
+	return err
+}
+
+// Flush отправляет клиенту всё записанное, в том числе из буфера
+// сжатия. Потоковый ответ сжимается независимо от объёма, уже
+// накопленного к первому Flush.
+func (w *compressWriter) Flush() {
+	if !w.decided {
+		if err := w.decide(true); err != nil {
 			return
 		}
-
-		// Создаем gzip.Writer поверх текущего w
-		gz, err := gzip.NewWriterLevel(w, gzip.BestSpeed)
-		if err != nil {
-			io.WriteString(w, err.Error())
+	}
+	if w.enc != nil {
+		if err := w.enc.Flush(); err != nil {
 			return
 		}
-		defer gz.Close()
+	}
+	http.NewResponseController(w.ResponseWriter).Flush()
+}
 
-		w.Header().Set("Content-Encoding", "gzip")
-		next.ServeHTTP(gzipWriter{ResponseWriter: w, Writer: gz}, r)
-	})
+// close завершает ответ и возвращает писатель в пул.
+func (w *compressWriter) close() error {
+	if !w.decided {
+		if w.status == 0 && len(w.buf) == 0 {
+			// Обработчик ничего не записал — ответ отправит net/http
+			w.decided = true
+			return nil
+		}
+		if err := w.decide(false); err != nil {
+			return err
+		}
+	}
+	if w.enc == nil {
+		return nil
+	}
+	err := w.enc.Close()
+	w.enc.Reset(nil)
+	encoderPools[w.encoding].Put(w.enc)
+	w.enc = nil
+	return err
+}
+
+// Unwrap нужен http.ResponseController для дедлайнов и Hijack. Flush
+// реализован самим compressWriter, чтобы сначала сбросить буфер сжатия.
+func (w *compressWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
 }
 
-func DecompressRequest(next http.Handler) http.Handler {
+// CompressResponse сжимает ответы текстовых типов кодировкой, выбранной
+// по Accept-Encoding клиента: br, gzip или deflate.
+func CompressResponse(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		// Проверяем, что запрос сжат
-		if !strings.Contains(r.Header.Get("Content-Encoding"), "gzip") {
+		// Ответ зависит от Accept-Encoding, даже если в итоге не сжат
+		w.Header().Add("Vary", "Accept-Encoding")
+
+		encoding := negotiateEncoding(r.Header.Get("Accept-Encoding"))
+		if encoding == "" || r.Method == http.MethodHead {
 			next.ServeHTTP(w, r)
 			return
 		}
 
-		// Создаем gzip.Reader поверх текущего тела запроса
-		gz, err := gzip.NewReader(r.Body)
-		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
+		cw := &compressWriter{ResponseWriter: w, encoding: encoding}
+		next.ServeHTTP(cw, r)
+		cw.close()
+	})
+}
+
+// ErrMalformedBody возвращается при чтении тела запроса, сжатие которого
+// повреждено.
+var ErrMalformedBody = errors.New("malformed compressed request body")
+
+// BodyLimits ограничивает размер тела запроса. Нулевое значение поля
+// снимает соответствующее ограничение.
+type BodyLimits struct {
+	// MaxSize — предельный размер тела в том виде, в каком оно передано.
+	MaxSize int64
+	// MaxDecompressedSize — предельный размер тела после распаковки.
+	MaxDecompressedSize int64
+}
+
+// DecompressRequest распаковывает тело запроса в gzip и ограничивает его
+// размер до и после распаковки. При превышении лимита чтение тела
+// возвращает *http.MaxBytesError, а при повреждённом сжатии — ошибку,
+// обёртывающую ErrMalformedBody. Заведомо большое тело и неверный
+// заголовок gzip отклоняются сразу статусами 413 и 400.
+func DecompressRequest(limits BodyLimits) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if limits.MaxSize > 0 {
+				if r.ContentLength > limits.MaxSize {
+					writeTooLarge(w, limits.MaxSize)
+					return
+				}
+				r.Body = http.MaxBytesReader(w, r.Body, limits.MaxSize)
+			}
+
+			// Проверяем, что запрос сжат
+			if !strings.Contains(r.Header.Get("Content-Encoding"), "gzip") {
+				if limits.MaxDecompressedSize > 0 {
+					// Без сжатия тело целиком попадает в память обработчика
+					r.Body = http.MaxBytesReader(w, r.Body, limits.MaxDecompressedSize)
+				}
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			// Создаем gzip.Reader поверх текущего тела запроса
+			gz, err := gzip.NewReader(r.Body)
+			if err != nil {
+				var maxErr *http.MaxBytesError
+				if errors.As(err, &maxErr) {
+					writeTooLarge(w, maxErr.Limit)
+					return
+				}
+				writeBodyError(w, http.StatusBadRequest, "request body is not valid gzip")
+				return
+			}
+			defer gz.Close()
+
+			// Заменяем тело запроса на распакованное
+			r.Body = &decompressedBody{r: gz, closer: r.Body, remaining: limits.MaxDecompressedSize, limit: limits.MaxDecompressedSize}
+			r.Header.Del("Content-Encoding")
+			r.Header.Del("Content-Length")
+			r.ContentLength = -1
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// decompressedBody читает распакованное тело не дальше limit байт
+// и помечает ошибки распаковки.
+type decompressedBody struct {
+	r         io.Reader
+	closer    io.Closer
+	remaining int64
+	limit     int64 // 0 — без ограничения
+}
+
+func (b *decompressedBody) Read(p []byte) (int, error) {
+	if b.limit > 0 {
+		if b.remaining < 0 {
+			return 0, &http.MaxBytesError{Limit: b.limit}
+		}
+		// Читаем на байт больше остатка, чтобы заметить превышение
+		if int64(len(p)) > b.remaining+1 {
+			p = p[:b.remaining+1]
+		}
+	}
+	n, err := b.r.Read(p)
+	if b.limit > 0 {
+		if int64(n) > b.remaining {
+			n = int(b.remaining)
+			b.remaining = -1
+			return n, &http.MaxBytesError{Limit: b.limit}
 		}
-		defer gz.Close()
+		b.remaining -= int64(n)
+	}
+	if err != nil && malformed(err) {
+		err = fmt.Errorf("%w: %v", ErrMalformedBody, err)
+	}
+	return n, err
+}
 
-		// Заменяем тело запроса на распакованное
-		r.Body = io.NopCloser(gz)
-		next.ServeHTTP(w, r)
-	})
+func (b *decompressedBody) Close() error {
+	return b.closer.Close()
+}
+
+// malformed сообщает, что err вызвана повреждённым потоком gzip, а не
+// обрывом соединения или лимитом размера.
+func malformed(err error) bool {
+	var corrupt flate.CorruptInputError
+	return errors.Is(err, gzip.ErrChecksum) || errors.Is(err, gzip.ErrHeader) ||
+		errors.Is(err, io.ErrUnexpectedEOF) || errors.As(err, &corrupt)
+}
+
+func writeTooLarge(w http.ResponseWriter, limit int64) {
+	writeBodyError(w, http.StatusRequestEntityTooLarge, fmt.Sprintf("request body exceeds %d bytes", limit))
+}
+
+// writeBodyError отвечает JSON-ошибкой в формате обработчиков.
+func writeBodyError(w http.ResponseWriter, status int, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(struct {
+		Error string `json:"error"`
+	}{message})
 }
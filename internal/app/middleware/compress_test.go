@@ -0,0 +1,298 @@
+package middleware
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/andybalholm/brotli"
+)
+
+func TestNegotiateEncoding(t *testing.T) {
+	tests := []struct {
+		header   string
+		expected string
+	}{
+		{"", ""},
+		{"gzip", "gzip"},
+		{"gzip, deflate, br", "br"},
+		{"deflate;q=0.5, gzip;q=0.8", "gzip"},
+		{"br;q=0, gzip;q=0", ""},
+		{"GZIP ; Q=0.3, identity", "gzip"},
+		{"*", "br"},
+		{"*;q=0.1, br;q=0", "gzip"},
+		{"gzip;q=bad, deflate", "deflate"},
+		{"identity", ""},
+	}
+	for _, tt := range tests {
+		if got := negotiateEncoding(tt.header); got != tt.expected {
+			t.Errorf("negotiateEncoding(%q) = %q, expected %q", tt.header, got, tt.expected)
+		}
+	}
+}
+
+func decode(t *testing.T, encoding string, r io.Reader) string {
+	t.Helper()
+	var (
+		dr  io.Reader
+		err error
+	)
+	switch encoding {
+	case "gzip":
+		dr, err = gzip.NewReader(r)
+	case "deflate":
+		dr, err = zlib.NewReader(r)
+	case "br":
+		dr = brotli.NewReader(r)
+	default:
+		dr = r
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := io.ReadAll(dr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(body)
+}
+
+func TestCompressResponse(t *testing.T) {
+	large := strings.Repeat("https://ya.ru ", minCompressSize)
+
+	tests := []struct {
+		name           string
+		acceptEncoding string
+		contentType    string // пустой — тип определяет net/http по телу
+		body           string
+		status         int
+		encoding       string
+	}{
+		{"json", "gzip", "application/json", `{"result":"` + large + `"}`, http.StatusOK, "gzip"},
+		{"sniffed plain text", "gzip", "", large, http.StatusCreated, "gzip"},
+		{"brotli", "br;q=1, gzip;q=0.5", "text/csv", large, http.StatusOK, "br"},
+		{"deflate", "deflate", "application/x-ndjson", large, http.StatusOK, "deflate"},
+		{"below threshold", "gzip", "application/json", `{"error":"not found"}`, http.StatusNotFound, ""},
+		{"binary", "gzip", "image/png", large, http.StatusOK, ""},
+		{"not accepted", "", "application/json", large, http.StatusOK, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			handler := CompressResponse(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if tt.contentType != "" {
+					w.Header().Set("Content-Type", tt.contentType)
+				}
+				w.Header().Set("Content-Length", strconv.Itoa(len(tt.body)))
+				w.WriteHeader(tt.status)
+				// Тело пишется частями, чтобы порог набирался постепенно
+				for i := 0; i < len(tt.body); i += 100 {
+					io.WriteString(w, tt.body[i:min(i+100, len(tt.body))])
+				}
+			}))
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.Header.Set("Accept-Encoding", tt.acceptEncoding)
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, req)
+
+			if w.Code != tt.status {
+				t.Errorf("Expected status %d, got %d", tt.status, w.Code)
+			}
+			if got := w.Header().Get("Content-Encoding"); got != tt.encoding {
+				t.Errorf("Expected Content-Encoding %q, got %q", tt.encoding, got)
+			}
+			if got := w.Header().Get("Vary"); got != "Accept-Encoding" {
+				t.Errorf("Expected Vary: Accept-Encoding, got %q", got)
+			}
+			if tt.encoding != "" && w.Header().Get("Content-Length") != "" {
+				t.Error("Expected Content-Length to be dropped from compressed response")
+			}
+			if got := decode(t, tt.encoding, w.Body); got != tt.body {
+				t.Errorf("Body mismatch: got %d bytes, expected %d", len(got), len(tt.body))
+			}
+		})
+	}
+}
+
+func TestCompressResponseRepeatedWriteHeader(t *testing.T) {
+	large := strings.Repeat("https://ya.ru ", minCompressSize)
+	handler := CompressResponse(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		w.WriteHeader(http.StatusCreated)
+		// Повторный статус игнорируется и до, и после отправки заголовков
+		w.WriteHeader(http.StatusInternalServerError)
+		io.WriteString(w, large)
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+
+	if w.Code != http.StatusCreated {
+		t.Errorf("Expected status %d, got %d", http.StatusCreated, w.Code)
+	}
+	if got := w.Header().Get("Content-Encoding"); got != "gzip" {
+		t.Errorf("Expected Content-Encoding gzip, got %q", got)
+	}
+	if got := decode(t, "gzip", w.Body); got != large {
+		t.Errorf("Body mismatch: got %d bytes, expected %d", len(got), len(large))
+	}
+}
+
+func TestCompressResponseFlush(t *testing.T) {
+	flushed := make(chan struct{})
+	handler := CompressResponse(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		io.WriteString(w, "{\"type\":\"progress\"}\n")
+		if err := http.NewResponseController(w).Flush(); err != nil {
+			t.Error(err)
+		}
+		<-flushed
+		io.WriteString(w, "{\"type\":\"done\"}\n")
+	}))
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	req, err := http.NewRequest(http.MethodPost, server.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Accept-Encoding", "gzip")
+	resp, err := http.DefaultTransport.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if got := resp.Header.Get("Content-Encoding"); got != "gzip" {
+		t.Fatalf("Expected gzip stream, got %q", got)
+	}
+
+	// Первая строка должна прийти до конца ответа
+	gz, err := gzip.NewReader(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	line := make([]byte, len("{\"type\":\"progress\"}\n"))
+	if _, err := io.ReadFull(gz, line); err != nil {
+		t.Fatal(err)
+	}
+	close(flushed)
+	rest, err := io.ReadAll(gz)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(line)+string(rest) != "{\"type\":\"progress\"}\n{\"type\":\"done\"}\n" {
+		t.Errorf("Unexpected stream %q%q", line, rest)
+	}
+}
+
+func gzipBytes(t testing.TB, data []byte) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	if _, err := gz.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := gz.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// bodyLimitsForTest — лимиты тестов распаковки.
+var bodyLimitsForTest = BodyLimits{MaxSize: 1 << 10, MaxDecompressedSize: 4 << 10}
+
+// readingHandler читает тело так же, как обработчики сервиса, и сообщает
+// статусом, чем закончилось чтение.
+func readingHandler(t testing.TB) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		var maxErr *http.MaxBytesError
+		switch {
+		case errors.As(err, &maxErr):
+			w.WriteHeader(http.StatusRequestEntityTooLarge)
+		case errors.Is(err, ErrMalformedBody):
+			w.WriteHeader(http.StatusBadRequest)
+		case err != nil:
+			t.Errorf("Unexpected read error %v", err)
+			w.WriteHeader(http.StatusInternalServerError)
+		case int64(len(body)) > bodyLimitsForTest.MaxDecompressedSize:
+			t.Errorf("Read %d bytes past the decompressed limit", len(body))
+			w.WriteHeader(http.StatusInternalServerError)
+		default:
+			w.Write(body)
+		}
+	})
+}
+
+func serveCompressed(t testing.TB, body []byte, encoding string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(body))
+	if encoding != "" {
+		req.Header.Set("Content-Encoding", encoding)
+	}
+	w := httptest.NewRecorder()
+	DecompressRequest(bodyLimitsForTest)(readingHandler(t)).ServeHTTP(w, req)
+	return w
+}
+
+func TestDecompressRequest(t *testing.T) {
+	valid := gzipBytes(t, []byte("https://ya.ru"))
+	// 64 КиБ нулей сжимаются примерно в сотню байт: лимит срабатывает
+	// только после распаковки
+	bomb := gzipBytes(t, make([]byte, 64<<10))
+	if len(bomb) > int(bodyLimitsForTest.MaxSize) {
+		t.Fatalf("Bomb is %d bytes compressed", len(bomb))
+	}
+	corrupted := append([]byte(nil), valid...)
+	corrupted[len(corrupted)-5] ^= 0xff
+
+	tests := []struct {
+		name     string
+		body     []byte
+		encoding string
+		status   int
+	}{
+		{"plain", []byte("https://ya.ru"), "", http.StatusOK},
+		{"plain too large", bytes.Repeat([]byte("a"), 2<<10), "", http.StatusRequestEntityTooLarge},
+		{"gzip", valid, "gzip", http.StatusOK},
+		{"bomb", bomb, "gzip", http.StatusRequestEntityTooLarge},
+		{"bad header", []byte("not gzip at all"), "gzip", http.StatusBadRequest},
+		{"truncated", valid[:len(valid)-4], "gzip", http.StatusBadRequest},
+		{"bad checksum", corrupted, "gzip", http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := serveCompressed(t, tt.body, tt.encoding)
+			if w.Code != tt.status {
+				t.Errorf("Expected status %d, got %d", tt.status, w.Code)
+			}
+			if tt.status == http.StatusOK && w.Body.String() != "https://ya.ru" {
+				t.Errorf("Unexpected body %q", w.Body.String())
+			}
+		})
+	}
+}
+
+func FuzzDecompressRequest(f *testing.F) {
+	f.Add(gzipBytes(f, []byte("https://ya.ru")))
+	f.Add(gzipBytes(f, make([]byte, 1<<20)))
+	f.Add(gzipBytes(f, bytes.Repeat([]byte("abc"), 2000)))
+	f.Add([]byte{0x1f, 0x8b, 0x08, 0x00})
+	f.Add([]byte{})
+
+	f.Fuzz(func(t *testing.T, body []byte) {
+		w := serveCompressed(t, body, "gzip")
+		switch w.Code {
+		case http.StatusOK, http.StatusBadRequest, http.StatusRequestEntityTooLarge:
+		default:
+			t.Errorf("Unexpected status %d", w.Code)
+		}
+	})
+}
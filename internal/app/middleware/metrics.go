@@ -0,0 +1,37 @@
+package middleware
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/vvityuk/shortener/internal/metrics"
+)
+
+// unmatchedRoute — метка маршрута для запросов, не попавших ни в один маршрут.
+const unmatchedRoute = "unmatched"
+
+// Metrics считает запросы и их длительность в разрезе шаблона маршрута chi,
+// а не сырого URI, чтобы число рядов не росло с числом коротких кодов.
+func Metrics(reg *metrics.Registry) func(http.Handler) http.Handler {
+	requests := reg.NewCounterVec("http_requests_total", "Total HTTP requests by route and status.", "method", "route", "status")
+	duration := reg.NewHistogramVec("http_request_duration_seconds", "HTTP request latency by route.", metrics.DefBuckets, "method", "route")
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			start := time.Now()
+			lrw := &loggingResponseWriter{ResponseWriter: w, statusCode: http.StatusOK}
+			next.ServeHTTP(lrw, r)
+
+			// Шаблон известен только после маршрутизации, которую chi
+			// выполняет внутри next
+			route := unmatchedRoute
+			if rctx := chi.RouteContext(r.Context()); rctx != nil && rctx.RoutePattern() != "" {
+				route = rctx.RoutePattern()
+			}
+			requests.WithLabelValues(r.Method, route, strconv.Itoa(lrw.statusCode)).Inc()
+			duration.WithLabelValues(r.Method, route).Observe(time.Since(start).Seconds())
+		})
+	}
+}
@@ -0,0 +1,103 @@
+package app
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"slices"
+	"strings"
+
+	"github.com/vvityuk/shortener/internal/config"
+	"golang.org/x/net/idna"
+)
+
+// defaultURLSchemes разрешены, если в конфигурации схемы не заданы.
+var defaultURLSchemes = []string{"http", "https"}
+
+// defaultPorts — порты, которые подразумеваются схемой.
+var defaultPorts = map[string]string{
+	"http":  "80",
+	"https": "443",
+}
+
+// normalizeURL проверяет исходный URL и приводит его к каноническому виду,
+// по которому ищутся уже сокращённые ссылки: схема и хост в нижнем
+// регистре, IDN-хост в punycode. Порт по умолчанию и фрагмент удаляются,
+// если это включено в cfg.
+func normalizeURL(raw string, cfg *config.Config) (string, error) {
+	raw = strings.TrimSpace(raw)
+	if raw == "" {
+		return "", fmt.Errorf("%w: URL is required", ErrInvalidURL)
+	}
+	// Длина проверяется и до разбора, чтобы не разбирать заведомо длинные строки
+	if cfg.MaxURLLength > 0 && len(raw) > cfg.MaxURLLength {
+		return "", fmt.Errorf("%w: URL exceeds %d bytes", ErrInvalidURL, cfg.MaxURLLength)
+	}
+
+	u, err := url.Parse(raw)
+	if err != nil {
+		return "", fmt.Errorf("%w: %v", ErrInvalidURL, err)
+	}
+	// url.Parse уже приводит схему к нижнему регистру
+	schemes := cfg.URLSchemes
+	if len(schemes) == 0 {
+		schemes = defaultURLSchemes
+	}
+	if u.Scheme == "" {
+		return "", fmt.Errorf("%w: scheme is required", ErrInvalidURL)
+	}
+	if !slices.Contains(schemes, u.Scheme) {
+		return "", fmt.Errorf("%w: scheme %q is not allowed", ErrInvalidURL, u.Scheme)
+	}
+	if u.Opaque != "" || u.Host == "" {
+		return "", fmt.Errorf("%w: host is required", ErrInvalidURL)
+	}
+
+	host, err := normalizeHost(u.Hostname())
+	if err != nil {
+		return "", err
+	}
+	port := u.Port()
+	if port == defaultPorts[u.Scheme] && cfg.StripDefaultPort {
+		port = ""
+	}
+	if port != "" {
+		u.Host = net.JoinHostPort(host, port)
+	} else if strings.Contains(host, ":") {
+		u.Host = "[" + host + "]"
+	} else {
+		u.Host = host
+	}
+
+	if cfg.StripFragment {
+		u.Fragment, u.RawFragment = "", ""
+	}
+
+	normalized := u.String()
+	if cfg.MaxURLLength > 0 && len(normalized) > cfg.MaxURLLength {
+		return "", fmt.Errorf("%w: URL exceeds %d bytes", ErrInvalidURL, cfg.MaxURLLength)
+	}
+	return normalized, nil
+}
+
+// hostProfile — правила IDNA для поиска, но без STD3: подчёркивания
+// встречаются в реальных именах хостов.
+var hostProfile = idna.New(idna.MapForLookup(), idna.BidiRule(), idna.StrictDomainName(false))
+
+// normalizeHost приводит хост к нижнему регистру, а IDN — к punycode.
+// Одна завершающая точка полного имени отбрасывается: example.com.
+// и example.com — один хост. IP-адреса не меняются, кроме регистра IPv6.
+func normalizeHost(host string) (string, error) {
+	host = strings.TrimSuffix(host, ".")
+	if host == "" {
+		return "", fmt.Errorf("%w: host is required", ErrInvalidURL)
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		return strings.ToLower(host), nil
+	}
+	ascii, err := hostProfile.ToASCII(host)
+	if err != nil {
+		return "", fmt.Errorf("%w: invalid host %q", ErrInvalidURL, host)
+	}
+	return ascii, nil
+}
@@ -0,0 +1,101 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/vvityuk/shortener/internal/config"
+	appstorage "github.com/vvityuk/shortener/internal/storage"
+	"go.uber.org/zap"
+)
+
+func TestNormalizeURL(t *testing.T) {
+	cfg := &config.Config{MaxURLLength: 64, StripDefaultPort: true}
+	tests := []struct {
+		raw      string
+		expected string // пустой — URL отклоняется
+	}{
+		{"HTTP://Example.COM:80/Path?Q=1", "http://example.com/Path?Q=1"},
+		{"  https://example.com:443/  ", "https://example.com/"},
+		{"https://example.com:8443/a", "https://example.com:8443/a"},
+		{"http://example.com:443/", "http://example.com:443/"},
+		{"https://пример.рф/путь", "https://xn--e1afmkfd.xn--p1ai/%D0%BF%D1%83%D1%82%D1%8C"},
+		{"http://[2001:DB8::1]:80/", "http://[2001:db8::1]/"},
+		{"http://user@example.com/#top", "http://user@example.com/#top"},
+		{"http://A_B.example.com/", "http://a_b.example.com/"},
+		{"https://Example.com./a", "https://example.com/a"},
+		{"https://example.com.:443/", "https://example.com/"},
+		{"http://./", ""},
+		{"", ""},
+		{"example.com", ""},
+		{"ftp://example.com/file", ""},
+		{"javascript:alert(1)", ""},
+		{"http:///path", ""},
+		{"http://exa mple.com/", ""},
+		{"http://example.com/" + strings.Repeat("a", 64), ""},
+	}
+	for _, tt := range tests {
+		got, err := normalizeURL(tt.raw, cfg)
+		if tt.expected == "" {
+			if !errors.Is(err, ErrInvalidURL) {
+				t.Errorf("normalizeURL(%q) = %q, %v, expected ErrInvalidURL", tt.raw, got, err)
+			}
+			continue
+		}
+		if err != nil || got != tt.expected {
+			t.Errorf("normalizeURL(%q) = %q, %v, expected %q", tt.raw, got, err, tt.expected)
+		}
+	}
+
+	// Настройки нормализации
+	cfg = &config.Config{URLSchemes: []string{"ftp"}, StripFragment: true}
+	if got, err := normalizeURL("FTP://Example.com:80/file#part", cfg); err != nil || got != "ftp://example.com:80/file" {
+		t.Errorf("Expected ftp URL without fragment, got %q, %v", got, err)
+	}
+	if _, err := normalizeURL("https://example.com/", cfg); !errors.Is(err, ErrInvalidURL) {
+		t.Errorf("Expected https to be rejected, got %v", err)
+	}
+}
+
+func TestCreateURLNormalizedDedup(t *testing.T) {
+	service, err := newService(NewMemoryStorage(), &config.Config{BaseURL: "http://localhost:8080", StripDefaultPort: true}, zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer service.Close()
+	ctx := context.Background()
+
+	code, err := service.CreateURL(ctx, "HTTP://Example.com:80/", CreateOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	again, err := service.CreateURL(ctx, "http://example.com/", CreateOptions{})
+	if !errors.Is(err, appstorage.ErrConflict) || again != code {
+		t.Errorf("Expected conflict with %q, got %q (err: %v)", code, again, err)
+	}
+
+	items := []BatchItem{{OriginalURL: "http://EXAMPLE.com/"}, {OriginalURL: "https://Go.dev"}, {OriginalURL: "https://go.dev:443"}, {OriginalURL: "mailto:me@example.com"}}
+	results, err := service.BatchCreateURL(ctx, items)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if results[0].ShortURL != code || results[0].Status != BatchExisting {
+		t.Errorf("Expected existing %q, got %+v", code, results[0])
+	}
+	if results[1].Status != BatchCreated || results[2].ShortURL != results[1].ShortURL {
+		t.Errorf("Expected one code for both go.dev forms, got %+v and %+v", results[1], results[2])
+	}
+	if results[3].Status != BatchInvalid || !errors.Is(results[3].Err, ErrInvalidURL) {
+		t.Errorf("Expected mailto to be rejected, got %+v", results[3])
+	}
+	if items[1].OriginalURL != "https://Go.dev" {
+		t.Errorf("Expected caller's batch to stay intact, got %q", items[1].OriginalURL)
+	}
+
+	u, err := service.GetURL(ctx, results[1].ShortURL)
+	if err != nil || u.OriginalURL != "https://go.dev" {
+		t.Errorf("Expected normalized URL to be stored, got %q (err: %v)", u.OriginalURL, err)
+	}
+}
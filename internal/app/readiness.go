@@ -0,0 +1,94 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/vvityuk/shortener/internal/health"
+)
+
+const (
+	// readinessTimeout ограничивает каждую проверку готовности.
+	readinessTimeout = 2 * time.Second
+	// minFreeDiskSpace — сколько места должно оставаться на диске файлового
+	// хранилища, чтобы сервис считался готовым.
+	minFreeDiskSpace = 64 << 20
+	// queueHighWater — доля заполнения очереди фоновой задачи, начиная
+	// с которой сервис перестаёт считаться готовым.
+	queueHighWater = 0.9
+)
+
+// errDiskFreeUnsupported возвращается, если свободное место на диске
+// нельзя узнать на этой платформе.
+var errDiskFreeUnsupported = errors.New("free disk space is not available on this platform")
+
+// newReadiness собирает проверки готовности сервиса. raw — хранилище
+// без обёрток, по его типу определяются применимые проверки.
+func (s *Service) newReadiness(raw Storage) *health.Checker {
+	c := health.NewChecker(readinessTimeout)
+	c.Add("shutdown", func(context.Context) error {
+		if s.draining.Load() {
+			return ErrShuttingDown
+		}
+		return nil
+	})
+	c.Add("storage", s.storage.Ping)
+	if fs, ok := raw.(*FileStorage); ok {
+		c.Add("file_storage", func(context.Context) error {
+			return fs.checkWritable()
+		})
+	}
+	c.Add("delete_queue", func(context.Context) error {
+		return checkQueue(s.deleter.batcher.queued())
+	})
+	c.Add("click_queue", func(context.Context) error {
+		return checkQueue(s.clicks.batcher.queued())
+	})
+	return c
+}
+
+func checkQueue(n, capacity int) error {
+	if float64(n) >= queueHighWater*float64(capacity) {
+		return fmt.Errorf("queue is above high-water mark: %d of %d", n, capacity)
+	}
+	return nil
+}
+
+// checkWritable проверяет, что в каталог журнала можно писать и на диске
+// достаточно места для дозаписи и уплотнения журнала.
+func (s *FileStorage) checkWritable() error {
+	dir := filepath.Dir(s.path)
+	probe, err := os.CreateTemp(dir, ".readyz-*")
+	if err != nil {
+		return fmt.Errorf("storage directory is not writable: %w", err)
+	}
+	probe.Close()
+	os.Remove(probe.Name())
+
+	free, err := diskFree(dir)
+	if errors.Is(err, errDiskFreeUnsupported) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if free < minFreeDiskSpace {
+		return fmt.Errorf("only %d bytes free on storage disk", free)
+	}
+	return nil
+}
+
+// Readiness возвращает проверки готовности сервиса.
+func (s *Service) Readiness() *health.Checker {
+	return s.readiness
+}
+
+// Drain помечает сервис как завершающий работу: проверка готовности
+// перестаёт проходить, чтобы оркестратор снял с него трафик.
+func (s *Service) Drain() {
+	s.draining.Store(true)
+}
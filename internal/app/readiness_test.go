@@ -0,0 +1,76 @@
+package app
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/vvityuk/shortener/internal/config"
+	"github.com/vvityuk/shortener/internal/health"
+	"go.uber.org/zap"
+)
+
+func TestReadiness(t *testing.T) {
+	dir := t.TempDir()
+	fileStorage, err := NewStorage(filepath.Join(dir, "urls.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	service, err := newService(fileStorage, &config.Config{BaseURL: "http://localhost:8080"}, zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer service.Close()
+
+	// failed возвращает имена непройденных проверок
+	failed := func(expectedStatus int) []string {
+		t.Helper()
+		w := httptest.NewRecorder()
+		service.Readiness().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+		if w.Code != expectedStatus {
+			t.Errorf("Expected status %d, got %d", expectedStatus, w.Code)
+		}
+		var report health.Report
+		if err := json.NewDecoder(w.Body).Decode(&report); err != nil {
+			t.Fatal(err)
+		}
+		if len(report.Checks) != 5 {
+			t.Errorf("Expected 5 checks, got %+v", report.Checks)
+		}
+		var names []string
+		for _, c := range report.Checks {
+			if c.Status != health.StatusOK {
+				names = append(names, c.Name)
+			}
+		}
+		return names
+	}
+
+	if names := failed(http.StatusOK); len(names) != 0 {
+		t.Errorf("Expected all checks to pass, failed: %v", names)
+	}
+
+	if err := os.RemoveAll(dir); err != nil {
+		t.Fatal(err)
+	}
+	if names := failed(http.StatusServiceUnavailable); len(names) != 1 || names[0] != "file_storage" {
+		t.Errorf("Expected only file_storage to fail, failed: %v", names)
+	}
+
+	service.Drain()
+	if names := failed(http.StatusServiceUnavailable); len(names) != 2 || names[0] != "shutdown" {
+		t.Errorf("Expected shutdown and file_storage to fail, failed: %v", names)
+	}
+}
+
+func TestCheckQueue(t *testing.T) {
+	if err := checkQueue(899, 1000); err != nil {
+		t.Errorf("Expected queue below high-water mark to pass, got %v", err)
+	}
+	if err := checkQueue(900, 1000); err == nil {
+		t.Error("Expected queue at high-water mark to fail")
+	}
+}
@@ -2,84 +2,497 @@ package app
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/vvityuk/shortener/internal/config"
+	"github.com/vvityuk/shortener/internal/health"
+	"github.com/vvityuk/shortener/internal/metrics"
+	"github.com/vvityuk/shortener/internal/storage"
 	"github.com/vvityuk/shortener/internal/storage/postgres"
-	"golang.org/x/exp/rand"
+	"go.uber.org/zap"
 )
 
+// maxCodeAttempts ограничивает число попыток подобрать свободный короткий код.
+const maxCodeAttempts = 10
+
+var errCodeSpaceExhausted = errors.New("failed to find a free short code")
+
+// ErrInvalidURL возвращается для URL, который нельзя сократить.
+var ErrInvalidURL = errors.New("invalid URL")
+
+// CreateOptions — необязательные параметры новой ссылки.
+type CreateOptions struct {
+	// Alias — выбранный пользователем короткий код.
+	Alias string
+	// ExpiresAt — момент истечения ссылки, нулевое значение — бессрочно.
+	ExpiresAt time.Time
+	// UserID — владелец ссылки.
+	UserID string
+}
+
+// BatchItem — элемент пакетного сокращения.
+type BatchItem struct {
+	OriginalURL string
+	CreateOptions
+}
+
+// BatchStatus — итог обработки элемента пакета.
+type BatchStatus string
+
+const (
+	// BatchCreated — создана новая ссылка.
+	BatchCreated BatchStatus = "created"
+	// BatchExisting — URL уже был сокращён, возвращён код существующей ссылки.
+	BatchExisting BatchStatus = "existing"
+	// BatchInvalid — элемент отклонён, причина в BatchResult.Err.
+	BatchInvalid BatchStatus = "invalid"
+)
+
+// BatchResult — результат обработки одного элемента пакета.
+type BatchResult struct {
+	ShortURL string
+	Status   BatchStatus
+	Err      error
+}
+
 type Service struct {
 	storage Storage
 	config  *config.Config
+	codes   CodeGenerator
+	logger  *zap.Logger
+	deleter *deleter
+	clicks  *clickRecorder
+	metrics *metrics.Registry
+
+	redirects *metrics.Counter
+	conflicts *metrics.Counter
+
+	readiness *health.Checker
+	draining  atomic.Bool
+
+	stop chan struct{}
+	wg   sync.WaitGroup
+}
+
+func NewService(cfg *config.Config, logger *zap.Logger) (*Service, error) {
+	storage, err := OpenStorage(cfg, logger)
+	if err != nil {
+		return nil, err
+	}
+	return newService(storage, cfg, logger)
 }
 
-func NewService(cfg *config.Config) (*Service, error) {
-	var storage Storage
-	var err error
+// OpenStorage открывает хранилище, выбранное в cfg.StorageBackend. Явно
+// выбранное хранилище либо открывается, либо возвращается ошибка. В режиме
+// auto по очереди пробуются PostgreSQL (если задан DSN), файл (если задан
+// путь) и память; выбор и причины пропуска остальных пишутся в лог.
+func OpenStorage(cfg *config.Config, logger *zap.Logger) (Storage, error) {
+	switch cfg.StorageBackend {
+	case config.StorageBackendPostgres:
+		return postgres.New(cfg.DatabaseDSN, PoolOptions(cfg))
+	case config.StorageBackendFile:
+		return OpenFileStorage(cfg.FileStoragePath, FileOptions{Logger: logger})
+	case config.StorageBackendMemory:
+		return NewMemoryStorage(), nil
+	case config.StorageBackendAuto:
+	default:
+		return nil, fmt.Errorf("unknown storage backend %q", cfg.StorageBackend)
+	}
 
 	// Пробуем PostgreSQL
-	if cfg.DatabaseDSN != "" {
-		storage, err = postgres.New(cfg.DatabaseDSN)
-		if err == nil {
-			return &Service{storage: storage, config: cfg}, nil
-		}
+	if cfg.DatabaseDSN == "" {
+		logger.Info("skipping postgres storage", zap.String("reason", "database DSN is not set"))
+	} else if storage, err := postgres.New(cfg.DatabaseDSN, PoolOptions(cfg)); err != nil {
+		logger.Warn("skipping postgres storage", zap.Error(err))
+	} else {
+		logger.Info("storage backend selected", zap.String("backend", config.StorageBackendPostgres))
+		return storage, nil
 	}
 
 	// Пробуем файловое хранилище
-	if cfg.FileStoragePath != "" {
-		storage, err = NewStorage(cfg.FileStoragePath)
-		if err == nil {
-			return &Service{storage: storage, config: cfg}, nil
-		}
+	if cfg.FileStoragePath == "" {
+		logger.Info("skipping file storage", zap.String("reason", "file storage path is not set"))
+	} else if storage, err := OpenFileStorage(cfg.FileStoragePath, FileOptions{Logger: logger}); err != nil {
+		logger.Warn("skipping file storage", zap.String("path", cfg.FileStoragePath), zap.Error(err))
+	} else {
+		logger.Info("storage backend selected", zap.String("backend", config.StorageBackendFile), zap.String("path", cfg.FileStoragePath))
+		return storage, nil
 	}
 
 	// Используем хранилище в памяти
-	storage = NewMemoryStorage()
-	return &Service{storage: storage, config: cfg}, nil
+	logger.Warn("storage backend selected, links will be lost on restart", zap.String("backend", config.StorageBackendMemory))
+	return NewMemoryStorage(), nil
+}
+
+// OpenStorageURI открывает хранилище по адресу вида memory:, file:<путь>
+// или postgres://... (postgresql://...). Настройки пула соединений берутся
+// из cfg.
+func OpenStorageURI(uri string, cfg *config.Config) (Storage, error) {
+	return openStorageURI(uri, cfg, false)
 }
 
-func (s *Service) GetURL(shortCode string) (string, bool) {
-	return s.storage.Get(shortCode)
+// OpenStorageURIReadOnly открывает существующее хранилище по адресу, как
+// OpenStorageURI, но только для чтения: файлы хранилища не меняются,
+// а к базе не применяются миграции. Если схема базы устарела,
+// возвращается ошибка.
+func OpenStorageURIReadOnly(uri string, cfg *config.Config) (Storage, error) {
+	return openStorageURI(uri, cfg, true)
 }
 
-func (s *Service) CreateURL(longURL string) (string, bool, error) {
-	shortURL := s.randStr(4)
-	return s.storage.Save(shortURL, longURL)
+func openStorageURI(uri string, cfg *config.Config, readOnly bool) (Storage, error) {
+	scheme, rest, _ := strings.Cut(uri, ":")
+	switch scheme {
+	case "memory":
+		return NewMemoryStorage(), nil
+	case "file":
+		if rest == "" {
+			return nil, fmt.Errorf("file path is required in %q", uri)
+		}
+		return OpenFileStorage(rest, FileOptions{ReadOnly: readOnly})
+	case "postgres", "postgresql":
+		if readOnly {
+			return postgres.NewReadOnly(uri, PoolOptions(cfg))
+		}
+		return postgres.New(uri, PoolOptions(cfg))
+	default:
+		return nil, fmt.Errorf("unsupported storage %q: use memory:, file:<path> or postgres://", uri)
+	}
+}
+
+// PoolOptions возвращает настройки пула соединений из конфигурации.
+func PoolOptions(cfg *config.Config) postgres.PoolOptions {
+	return postgres.PoolOptions{
+		MaxConns:          int32(cfg.DBMaxConns),
+		MinConns:          int32(cfg.DBMinConns),
+		MaxConnLifetime:   cfg.DBMaxConnLifetime,
+		HealthCheckPeriod: cfg.DBHealthCheckPeriod,
+	}
 }
 
-func (s *Service) randStr(n int) string {
-	rnd := rand.New(rand.NewSource(uint64(time.Now().UnixNano())))
+func newService(storage Storage, cfg *config.Config, logger *zap.Logger) (*Service, error) {
+	codes, err := NewCodeGenerator(cfg.CodeStrategy, cfg.ShortCodeLength, storage)
+	if err != nil {
+		storage.Close()
+		return nil, err
+	}
+
+	reg := metrics.NewRegistry()
+	registerStorageGauges(reg, storage)
+	// Генератор кодов и проверки готовности получают хранилище без обёртки:
+	// им важен его конкретный тип
+	raw := storage
+	storage = newInstrumentedStorage(storage, reg)
+
+	s := &Service{
+		storage:   storage,
+		config:    cfg,
+		codes:     codes,
+		logger:    logger,
+		deleter:   newDeleter(storage, logger),
+		clicks:    newClickRecorder(storage, logger),
+		metrics:   reg,
+		redirects: reg.NewCounter("shortener_redirects_total", "Successful redirects to original URLs."),
+		conflicts: reg.NewCounter("shortener_conflicts_total", "Shorten requests for URLs that were already shortened."),
+		stop:      make(chan struct{}),
+	}
+	s.readiness = s.newReadiness(raw)
+
+	if cfg.ExpiredSweepInterval > 0 {
+		s.wg.Add(1)
+		go s.sweepExpired(cfg.ExpiredSweepInterval)
+	}
+	return s, nil
+}
 
-	letters := []rune("0123456789abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ")
-	b := make([]rune, n)
-	for i := range b {
-		b[i] = letters[rnd.Intn(len(letters))]
+// GetURL возвращает ссылку по короткому коду. Для истёкшей или удалённой
+// ссылки возвращается storage.ErrGone.
+func (s *Service) GetURL(ctx context.Context, shortCode string) (storage.URL, error) {
+	u, err := s.storage.Get(ctx, shortCode)
+	if err != nil {
+		return storage.URL{}, err
+	}
+	if u.Gone(time.Now()) {
+		return u, storage.ErrGone
 	}
-	return string(b)
+	s.redirects.Inc()
+	return u, nil
 }
 
+// ForEachURL обходит все сохранённые ссылки, см. Storage.ForEach.
+func (s *Service) ForEachURL(ctx context.Context, fn func(storage.URL) error) error {
+	return s.storage.ForEach(ctx, fn)
+}
+
+// CreateURL сокращает longURL. Если URL уже сокращён, возвращается
+// существующий код вместе с ошибкой *storage.ConflictError. URL сравниваются
+// в нормализованном виде, см. normalizeURL.
+func (s *Service) CreateURL(ctx context.Context, longURL string, opts CreateOptions) (string, error) {
+	longURL, err := normalizeURL(longURL, s.config)
+	if err != nil {
+		return "", err
+	}
+	u := storage.URL{OriginalURL: longURL, UserID: opts.UserID, ExpiresAt: opts.ExpiresAt}
+
+	if opts.Alias != "" {
+		if err := validateAlias(opts.Alias); err != nil {
+			return "", err
+		}
+		u.ShortURL = opts.Alias
+		shortURL, err := s.storage.Save(ctx, u)
+		if errors.Is(err, storage.ErrCodeTaken) {
+			return "", fmt.Errorf("%w: %q", ErrAliasTaken, opts.Alias)
+		}
+		if errors.Is(err, storage.ErrConflict) {
+			s.conflicts.Inc()
+		}
+		return shortURL, err
+	}
+
+	for attempt := 0; attempt < maxCodeAttempts; attempt++ {
+		code, err := s.codes.Generate(ctx, longURL, attempt)
+		if err != nil {
+			return "", err
+		}
+
+		u.ShortURL = code
+		shortURL, err := s.storage.Save(ctx, u)
+		if errors.Is(err, storage.ErrCodeTaken) {
+			continue
+		}
+		if errors.Is(err, storage.ErrConflict) {
+			s.conflicts.Inc()
+		}
+		return shortURL, err
+	}
+	return "", errCodeSpaceExhausted
+}
+
+// GetUserURLs возвращает действующие ссылки пользователя userID.
+func (s *Service) GetUserURLs(ctx context.Context, userID string) ([]storage.URL, error) {
+	return s.storage.GetUserURLs(ctx, userID)
+}
+
+// DeleteUserURLs ставит в очередь удаление ссылок пользователя userID.
+// Удаление выполняется асинхронно.
+func (s *Service) DeleteUserURLs(userID string, codes []string) error {
+	items := make([]storage.DeleteRequest, 0, len(codes))
+	for _, code := range codes {
+		items = append(items, storage.DeleteRequest{UserID: userID, ShortURL: code})
+	}
+	return s.deleter.enqueue(items)
+}
+
+// Close останавливает фоновые задачи, дожидаясь обработки поставленных
+// в очередь удалений, и закрывает хранилище.
 func (s *Service) Close() error {
-	return s.storage.Close()
+	s.Drain()
+	close(s.stop)
+	s.wg.Wait()
+	s.deleter.close()
+	s.clicks.close()
+	s.logger.Info("background workers stopped")
+
+	if err := s.storage.Close(); err != nil {
+		return err
+	}
+	s.logger.Info("storage closed")
+	return nil
+}
+
+// Metrics возвращает реестр метрик сервиса.
+func (s *Service) Metrics() *metrics.Registry {
+	return s.metrics
 }
 
 func (s *Service) Ping(ctx context.Context) error {
 	return s.storage.Ping(ctx)
 }
 
-func (s *Service) BatchCreateURL(items map[string]string) (map[string]string, error) {
-	result := make(map[string]string)
-	urls := make(map[string]string)
+// BatchCreateURL сокращает пакет URL и возвращает результаты в порядке
+// элементов пакета. Каждый исходный URL сохраняется
+// один раз: уже сокращённые URL и повторы внутри пакета получают код
+// существующей ссылки. Ошибки отдельных элементов не прерывают обработку
+// пакета, а возвращаются в их результатах; ошибка функции означает,
+// что пакет не обработан.
+func (s *Service) BatchCreateURL(ctx context.Context, items []BatchItem) ([]BatchResult, error) {
+	results := make([]BatchResult, len(items))
+	invalid := func(i int, err error) {
+		results[i] = BatchResult{Status: BatchInvalid, Err: err}
+	}
+
+	// Дальше элементы сравниваются и сохраняются с нормализованными URL;
+	// копия не даёт изменить пакет вызывающего
+	items = slices.Clone(items)
 
-	for correlationID, originalURL := range items {
-		shortURL := s.randStr(4)
-		urls[shortURL] = originalURL
-		result[correlationID] = shortURL
+	// Первый элемент с данным URL сохраняется, остальные получают его результат
+	leaders := make(map[string]int)    // исходный URL -> индекс сохраняемого элемента
+	followers := make(map[int]int)     // индекс повтора -> индекс сохраняемого элемента
+	aliases := make(map[string]string) // пользовательский код -> исходный URL
+	var pending []int
+	for i := range items {
+		normalized, err := normalizeURL(items[i].OriginalURL, s.config)
+		if err != nil {
+			invalid(i, err)
+			continue
+		}
+		items[i].OriginalURL = normalized
+		item := items[i]
+		if item.Alias != "" {
+			if err := validateAlias(item.Alias); err != nil {
+				invalid(i, err)
+				continue
+			}
+		}
+		if leader, ok := leaders[item.OriginalURL]; ok {
+			if item.Alias != "" && item.Alias != items[leader].Alias {
+				invalid(i, fmt.Errorf("%w: URL is repeated in the batch with another alias", ErrInvalidAlias))
+				continue
+			}
+			followers[i] = leader
+			continue
+		}
+		if item.Alias != "" {
+			if _, ok := aliases[item.Alias]; ok {
+				invalid(i, fmt.Errorf("%w: %q is used twice in the batch", ErrAliasTaken, item.Alias))
+				continue
+			}
+			aliases[item.Alias] = item.OriginalURL
+		}
+		leaders[item.OriginalURL] = i
+		pending = append(pending, i)
 	}
 
-	if err := s.storage.BatchSave(urls); err != nil {
-		return nil, err
+	saved := false
+	for attempt := 0; attempt < maxCodeAttempts && !saved; attempt++ {
+		// Пользовательские коды не меняются между попытками
+		taken := make(map[string]string, len(pending))
+		for _, i := range pending {
+			if item := items[i]; item.Alias != "" {
+				taken[item.Alias] = item.OriginalURL
+			}
+		}
+
+		urls := make([]storage.URL, 0, len(pending))
+		for _, i := range pending {
+			item := items[i]
+			shortURL := item.Alias
+			if shortURL == "" {
+				var err error
+				if shortURL, err = s.uniqueCode(ctx, item.OriginalURL, attempt, taken); err != nil {
+					return nil, err
+				}
+				taken[shortURL] = item.OriginalURL
+			}
+			urls = append(urls, storage.URL{
+				ShortURL:    shortURL,
+				OriginalURL: item.OriginalURL,
+				UserID:      item.UserID,
+				ExpiresAt:   item.ExpiresAt,
+			})
+		}
+		if len(urls) == 0 {
+			break
+		}
+
+		stored, err := s.storage.BatchSave(ctx, urls)
+		if errors.Is(err, storage.ErrCodeTaken) {
+			// Занятый пользовательский код повторной попыткой не исправить:
+			// такие элементы отклоняются, остальные сохраняются заново
+			remaining := pending[:0]
+			for _, i := range pending {
+				alias := items[i].Alias
+				if alias == "" {
+					remaining = append(remaining, i)
+					continue
+				}
+				_, err := s.storage.Get(ctx, alias)
+				switch {
+				case err == nil:
+					invalid(i, fmt.Errorf("%w: %q", ErrAliasTaken, alias))
+				case errors.Is(err, storage.ErrNotFound):
+					remaining = append(remaining, i)
+				default:
+					return nil, err
+				}
+			}
+			pending = remaining
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		for j, i := range pending {
+			status := BatchCreated
+			if stored[j].Existing {
+				status = BatchExisting
+			}
+			results[i] = BatchResult{ShortURL: stored[j].ShortURL, Status: status}
+		}
+		saved = true
+	}
+	if !saved && len(pending) > 0 {
+		return nil, errCodeSpaceExhausted
 	}
 
-	return result, nil
+	for i, leader := range followers {
+		result := results[leader]
+		if result.Status == BatchCreated {
+			result.Status = BatchExisting
+		}
+		results[i] = result
+	}
+	for _, result := range results {
+		if result.Status == BatchExisting {
+			s.conflicts.Inc()
+		}
+	}
+	return results, nil
+}
+
+// uniqueCode генерирует код для originalURL, не совпадающий с уже выданными
+// в текущем пакете кодами другим URL.
+func (s *Service) uniqueCode(ctx context.Context, originalURL string, attempt int, taken map[string]string) (string, error) {
+	for ; attempt < maxCodeAttempts; attempt++ {
+		code, err := s.codes.Generate(ctx, originalURL, attempt)
+		if err != nil {
+			return "", err
+		}
+		if _, ok := taken[code]; !ok {
+			return code, nil
+		}
+	}
+	return "", errCodeSpaceExhausted
+}
+
+// sweepExpired периодически удаляет из хранилища ссылки, которые истекли
+// больше ExpiredRetention назад.
+func (s *Service) sweepExpired(interval time.Duration) {
+	defer s.wg.Done()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.stop:
+			return
+		case now := <-ticker.C:
+			// Истёкшие ссылки хранятся ещё ExpiredRetention, чтобы их
+			// коды отвечали 410, а не 404
+			n, err := s.storage.DeleteExpired(context.Background(), now.Add(-s.config.ExpiredRetention))
+			if err != nil {
+				s.logger.Error("failed to delete expired links", zap.Error(err))
+				continue
+			}
+			if n > 0 {
+				s.logger.Info("expired links deleted", zap.Int("count", n))
+			}
+		}
+	}
 }
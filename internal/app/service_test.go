@@ -0,0 +1,60 @@
+package app
+
+import (
+	"fmt"
+	"path/filepath"
+	"testing"
+
+	"github.com/vvityuk/shortener/internal/config"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+func TestOpenStorage(t *testing.T) {
+	// Порт 1 закрыт, подключение сразу завершается ошибкой
+	const badDSN = "postgres://user@127.0.0.1:1/db?connect_timeout=1"
+	badPath := filepath.Join(t.TempDir(), "missing", "urls.json")
+	goodPath := filepath.Join(t.TempDir(), "urls.json")
+
+	tests := []struct {
+		name    string
+		cfg     config.Config
+		wantErr bool
+		want    string // тип открытого хранилища
+		skipped int
+	}{
+		{"Postgres fails fast", config.Config{StorageBackend: config.StorageBackendPostgres, DatabaseDSN: badDSN}, true, "", 0},
+		{"File fails fast", config.Config{StorageBackend: config.StorageBackendFile, FileStoragePath: badPath}, true, "", 0},
+		{"Memory", config.Config{StorageBackend: config.StorageBackendMemory, DatabaseDSN: badDSN}, false, "*app.MemoryStorage", 0},
+		{"Auto picks file", config.Config{StorageBackend: config.StorageBackendAuto, DatabaseDSN: badDSN, FileStoragePath: goodPath}, false, "*app.FileStorage", 1},
+		{"Auto falls back to memory", config.Config{StorageBackend: config.StorageBackendAuto, FileStoragePath: badPath}, false, "*app.MemoryStorage", 2},
+		{"Unknown", config.Config{StorageBackend: "redis"}, true, "", 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			core, logs := observer.New(zap.InfoLevel)
+			storage, err := OpenStorage(&tt.cfg, zap.New(core))
+			if tt.wantErr {
+				if err == nil {
+					storage.Close()
+					t.Fatal("Expected an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer storage.Close()
+
+			if got := fmt.Sprintf("%T", storage); got != tt.want {
+				t.Errorf("Expected %s, got %s", tt.want, got)
+			}
+			if n := logs.FilterMessageSnippet("skipping").Len(); n != tt.skipped {
+				t.Errorf("Expected %d skipped backends to be logged, got %d", tt.skipped, n)
+			}
+			if tt.cfg.StorageBackend == config.StorageBackendAuto && logs.FilterMessageSnippet("storage backend selected").Len() != 1 {
+				t.Error("Expected the selected backend to be logged")
+			}
+		})
+	}
+}
@@ -1,165 +1,795 @@
 package app
 
 import (
+	"bufio"
+	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
 	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/vvityuk/shortener/internal/storage"
+	"go.uber.org/zap"
 )
 
+// Storage — хранилище ссылок. Все методы принимают контекст запроса
+// и сообщают о результате ошибками пакета storage.
 type Storage interface {
-	Get(key string) (string, bool)
-	Save(key, value string) (string, bool, error)
-	GetByOriginalURL(originalURL string) (string, bool)
-	BatchSave(items map[string]string) error
+	// Get возвращает ссылку по коду, в том числе истёкшую или удалённую,
+	// либо storage.ErrNotFound.
+	Get(ctx context.Context, key string) (storage.URL, error)
+	// Save сохраняет новую ссылку и возвращает её код. Если исходный URL
+	// уже сокращён, возвращается *storage.ConflictError с существующим кодом;
+	// если занят сам код — storage.ErrCodeTaken.
+	Save(ctx context.Context, u storage.URL) (string, error)
+	// GetByOriginalURL возвращает код действующей ссылки на originalURL
+	// либо storage.ErrNotFound.
+	GetByOriginalURL(ctx context.Context, originalURL string) (string, error)
+	// BatchSave сохраняет пакет ссылок и возвращает результат для каждой
+	// в том же порядке. Уже сокращённые URL и URL, повторяющиеся в пакете,
+	// не сохраняются заново, а получают код существующей ссылки.
+	// Новые ссылки сохраняются все или ни одной: storage.ErrCodeTaken
+	// означает, что хотя бы один код занят.
+	BatchSave(ctx context.Context, items []storage.URL) ([]storage.SaveResult, error)
+	// GetUserURLs возвращает действующие ссылки, созданные пользователем userID.
+	GetUserURLs(ctx context.Context, userID string) ([]storage.URL, error)
+	// DeleteExpired удаляет ссылки, срок действия которых истёк к now,
+	// и возвращает их количество.
+	DeleteExpired(ctx context.Context, now time.Time) (int, error)
+	// DeleteURLs помечает удалёнными ссылки из items, если они принадлежат
+	// указанным пользователям. Чужие и несуществующие коды пропускаются.
+	DeleteURLs(ctx context.Context, items []storage.DeleteRequest) error
+	// ForEach вызывает fn для каждой сохранённой ссылки, включая истёкшие
+	// и удалённые, в порядке создания, не загружая их в память все сразу.
+	// Ошибка fn прерывает обход и возвращается из ForEach.
+	ForEach(ctx context.Context, fn func(storage.URL) error) error
+	// Count возвращает число сохранённых ссылок, включая истёкшие и удалённые.
+	Count(ctx context.Context) (int, error)
+	// RecordClicks сохраняет переходы. Переходы по несуществующим кодам
+	// пропускаются.
+	RecordClicks(ctx context.Context, clicks []storage.Click) error
+	// ClickStats возвращает статистику переходов по ссылке shortURL.
+	// Ряд содержит только непустые интервалы q.Bucket в порядке времени.
+	ClickStats(ctx context.Context, shortURL string, q storage.StatsQuery) (storage.ClickStats, error)
 	Close() error
 	Ping(ctx context.Context) error
 }
 
+// compactMinRecords — минимальный размер журнала, после которого имеет смысл
+// сжимать его в снимок.
+const compactMinRecords = 1000
+
+// iteratePageSize — сколько ссылок ForEach читает за один захват блокировки.
+const iteratePageSize = 1000
+
+// sequenceBlock — сколько номеров последовательности файловое хранилище
+// резервирует одной записью на диск. Неиспользованный остаток блока
+// после перезапуска пропускается.
+const sequenceBlock = 100
+
+// fileRecord — одна запись журнала файлового хранилища (JSON Lines).
+// При повторе журнала более поздняя запись с тем же short_url заменяет
+// предыдущую, а запись с Purged удаляет ссылку.
+type fileRecord struct {
+	ShortURL    string     `json:"short_url"`
+	OriginalURL string     `json:"original_url,omitempty"`
+	UserID      string     `json:"user_id,omitempty"`
+	ExpiresAt   *time.Time `json:"expires_at,omitempty"`
+	Deleted     bool       `json:"is_deleted,omitempty"`
+	Purged      bool       `json:"purged,omitempty"`
+	CreatedAt   *time.Time `json:"created_at,omitempty"`
+}
+
+func newFileRecord(u storage.URL) fileRecord {
+	rec := fileRecord{ShortURL: u.ShortURL, OriginalURL: u.OriginalURL, UserID: u.UserID, Deleted: u.Deleted}
+	if !u.ExpiresAt.IsZero() {
+		rec.ExpiresAt = &u.ExpiresAt
+	}
+	if !u.CreatedAt.IsZero() {
+		rec.CreatedAt = &u.CreatedAt
+	}
+	return rec
+}
+
+func (rec fileRecord) url() storage.URL {
+	u := storage.URL{ShortURL: rec.ShortURL, OriginalURL: rec.OriginalURL, UserID: rec.UserID, Deleted: rec.Deleted}
+	if rec.ExpiresAt != nil {
+		u.ExpiresAt = *rec.ExpiresAt
+	}
+	if rec.CreatedAt != nil {
+		u.CreatedAt = *rec.CreatedAt
+	}
+	return u
+}
+
+// FileStorage безопасно для конкурентного использования: чтения идут под
+// разделяемой блокировкой и не ждут друг друга, записи сериализуются.
 type FileStorage struct {
-	urls map[string]string
-	file *os.File
+	mu      sync.RWMutex
+	index   *urlIndex
+	clicks  *clickLog
+	file    *os.File
+	path    string
+	records int // количество записей в журнале
+	logger  *zap.Logger
+	// readOnly запрещает любые изменения файлов хранилища
+	readOnly bool
+
+	// Пока журнал сжимается в фоне, новые записи копятся в pending,
+	// чтобы попасть и в новый журнал
+	compacting  bool
+	pending     []fileRecord
+	compactions sync.WaitGroup
+
+	seqNext  uint64 // последний выданный номер последовательности
+	seqLimit uint64 // граница зарезервированного на диске блока
 }
 
+// FileOptions — параметры файлового хранилища.
+type FileOptions struct {
+	// Logger получает ошибки фонового сжатия журнала.
+	Logger *zap.Logger
+	// ReadOnly открывает существующий журнал только для чтения: он не
+	// сжимается, не переводится из старого формата, недописанная строка
+	// не обрезается, а файл переходов не открывается. Запись возвращает
+	// storage.ErrReadOnly.
+	ReadOnly bool
+}
+
+// NewStorage открывает файловое хранилище с параметрами по умолчанию.
 func NewStorage(filePath string) (*FileStorage, error) {
-	file, err := os.OpenFile(filePath, os.O_RDWR|os.O_CREATE, 0644)
+	return OpenFileStorage(filePath, FileOptions{})
+}
+
+// OpenFileStorage открывает файловое хранилище filePath. Если журнала нет,
+// он создаётся, кроме режима только для чтения.
+func OpenFileStorage(filePath string, opts FileOptions) (*FileStorage, error) {
+	flags := os.O_RDWR | os.O_CREATE | os.O_APPEND
+	if opts.ReadOnly {
+		flags = os.O_RDONLY
+	}
+	file, err := os.OpenFile(filePath, flags, 0644)
 	if err != nil {
 		return nil, err
 	}
+	if opts.Logger == nil {
+		opts.Logger = zap.NewNop()
+	}
 
 	storage := &FileStorage{
-		urls: make(map[string]string),
-		file: file,
+		index:    newURLIndex(),
+		file:     file,
+		path:     filePath,
+		logger:   opts.Logger,
+		readOnly: opts.ReadOnly,
 	}
 
 	if err := storage.load(); err != nil {
+		file.Close()
+		return nil, err
+	}
+	if err := storage.loadSequence(); err != nil {
+		file.Close()
+		return nil, err
+	}
+	if opts.ReadOnly {
+		storage.clicks = newClickLog()
+	} else if storage.clicks, err = openClickLog(storage.clicksPath(), storage.hasClickTarget, storage.logger); err != nil {
+		file.Close()
 		return nil, err
 	}
 
 	return storage, nil
 }
 
-func (s *FileStorage) Get(key string) (string, bool) {
-	val, ok := s.urls[key]
-	return val, ok
+func (s *FileStorage) Get(_ context.Context, key string) (storage.URL, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	u, ok := s.index.get(key)
+	if !ok {
+		return storage.URL{}, storage.ErrNotFound
+	}
+	return u, nil
+}
+
+func (s *FileStorage) Save(_ context.Context, u storage.URL) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	if existingKey, ok := s.index.liveKeyOf(u.OriginalURL, now); ok {
+		return existingKey, &storage.ConflictError{ShortURL: existingKey}
+	}
+	if _, ok := s.index.get(u.ShortURL); ok {
+		return "", storage.ErrCodeTaken
+	}
+	if u.CreatedAt.IsZero() {
+		u.CreatedAt = now
+	}
+	if err := s.append(newFileRecord(u)); err != nil {
+		return "", err
+	}
+	s.index.put(u)
+	s.compactIfNeeded()
+	return u.ShortURL, nil
+}
+
+func (s *FileStorage) GetByOriginalURL(_ context.Context, originalURL string) (string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	key, ok := s.index.liveKeyOf(originalURL, time.Now())
+	if !ok {
+		return "", storage.ErrNotFound
+	}
+	return key, nil
+}
+
+func (s *FileStorage) BatchSave(_ context.Context, items []storage.URL) ([]storage.SaveResult, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	results, fresh, err := s.index.batch(items, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	if len(fresh) == 0 {
+		return results, nil
+	}
+	records := make([]fileRecord, 0, len(fresh))
+	for _, u := range fresh {
+		records = append(records, newFileRecord(u))
+	}
+	if err := s.append(records...); err != nil {
+		return nil, err
+	}
+	for _, u := range fresh {
+		s.index.put(u)
+	}
+	s.compactIfNeeded()
+	return results, nil
+}
+
+func (s *FileStorage) GetUserURLs(_ context.Context, userID string) ([]storage.URL, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.index.byUser(userID, time.Now()), nil
+}
+
+// DeleteURLs дописывает в журнал новые состояния всех удаляемых ссылок
+// одной операцией записи.
+func (s *FileStorage) DeleteURLs(_ context.Context, items []storage.DeleteRequest) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	urls := s.index.deletable(items)
+	if len(urls) == 0 {
+		return nil
+	}
+	records := make([]fileRecord, 0, len(urls))
+	for _, u := range urls {
+		records = append(records, newFileRecord(u))
+	}
+	if err := s.append(records...); err != nil {
+		return err
+	}
+	for _, u := range urls {
+		s.index.put(u)
+	}
+	s.compactIfNeeded()
+	return nil
 }
 
-func (s *FileStorage) Save(key, value string) (string, bool, error) {
-	if existingKey, ok := s.getKeyByValue(value); ok {
-		return existingKey, false, nil
+// DeleteExpired дописывает в журнал записи об удалении истёкших ссылок
+// одной операцией записи.
+func (s *FileStorage) DeleteExpired(_ context.Context, now time.Time) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	keys := s.index.expired(now)
+	if len(keys) == 0 {
+		return 0, nil
+	}
+	records := make([]fileRecord, 0, len(keys))
+	for _, key := range keys {
+		records = append(records, fileRecord{ShortURL: key, Purged: true})
 	}
-	s.urls[key] = value
-	if err := s.save(); err != nil {
-		return "", false, err
+	if err := s.append(records...); err != nil {
+		return 0, err
 	}
-	return key, true, nil
+	for _, key := range keys {
+		s.index.remove(key)
+	}
+	s.clicks.drop(keys)
+	s.compactIfNeeded()
+	return len(keys), nil
+}
+
+func (s *FileStorage) ForEach(ctx context.Context, fn func(storage.URL) error) error {
+	return forEachSnapshot(ctx, &s.mu, s.index, fn)
+}
+
+func (s *FileStorage) Count(_ context.Context) (int, error) {
+	return s.indexSize(), nil
+}
+
+// indexSize возвращает число ссылок, восстановленных из журнала, включая
+// удалённые. Файл при этом не читается, поэтому метрика размера дешёвая.
+func (s *FileStorage) indexSize() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.index.len()
 }
 
-func (s *FileStorage) GetByOriginalURL(originalURL string) (string, bool) {
-	for key, value := range s.urls {
-		if value == originalURL {
-			return key, true
+// load восстанавливает состояние, последовательно применяя записи журнала.
+// Недописанная последняя строка (например, после падения посреди записи)
+// отбрасывается и обрезается. Файл в старом формате — один JSON-объект
+// со всеми ссылками — читается как снимок и сразу переписывается в журнал.
+func (s *FileStorage) load() error {
+	if _, err := s.file.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	reader := bufio.NewReader(s.file)
+	var offset int64 // конец последней корректной записи
+	legacy := false
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err != nil && err != io.EOF {
+			return err
+		}
+		if len(line) == 0 {
+			break
 		}
+
+		if applyErr := s.apply(line, &legacy); applyErr != nil {
+			// Битой может быть только последняя строка журнала.
+			if _, peekErr := reader.Peek(1); peekErr == nil {
+				return fmt.Errorf("corrupted journal record at offset %d: %w", offset, applyErr)
+			}
+			if s.readOnly {
+				break
+			}
+			if err := s.file.Truncate(offset); err != nil {
+				return err
+			}
+			break
+		}
+		offset += int64(len(line))
+		if line[len(line)-1] != '\n' && !s.readOnly {
+			// Запись цела, но перевод строки не успел записаться.
+			if _, err := s.file.Write([]byte{'\n'}); err != nil {
+				return err
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+	}
+
+	if s.readOnly {
+		return nil
 	}
-	return "", false
+	// При открытии запросов ещё нет, поэтому журнал сжимается сразу
+	if legacy {
+		s.compacting = true
+		return s.compact(s.snapshot())
+	}
+	if s.needsCompaction() {
+		s.compacting = true
+		if err := s.compact(s.snapshot()); err != nil {
+			s.logger.Error("failed to compact journal", zap.String("path", s.path), zap.Error(err))
+		}
+	}
+	return nil
 }
 
-func (s *FileStorage) getKeyByValue(value string) (string, bool) {
-	for key, val := range s.urls {
-		if val == value {
-			return key, true
+// apply применяет к состоянию одну строку журнала.
+func (s *FileStorage) apply(line []byte, legacy *bool) error {
+	line = bytes.TrimSpace(line)
+	if len(line) == 0 {
+		return nil
+	}
+
+	var rec fileRecord
+	if err := json.Unmarshal(line, &rec); err != nil {
+		return err
+	}
+	if rec.ShortURL != "" {
+		if rec.Purged {
+			s.index.remove(rec.ShortURL)
+		} else {
+			s.index.put(rec.url())
 		}
+		s.records++
+		return nil
+	}
+
+	// Старый формат: весь файл — один объект short_url -> original_url
+	var snapshot map[string]string
+	if err := json.Unmarshal(line, &snapshot); err != nil {
+		return err
 	}
-	return "", false
+	for key, value := range snapshot {
+		s.index.put(storage.URL{ShortURL: key, OriginalURL: value})
+	}
+	*legacy = true
+	return nil
+}
+
+// append дописывает записи в конец журнала одной операцией записи.
+func (s *FileStorage) append(records ...fileRecord) error {
+	if s.readOnly {
+		return storage.ErrReadOnly
+	}
+	if err := writeRecords(s.file, records); err != nil {
+		return err
+	}
+	s.records += len(records)
+	if s.compacting {
+		s.pending = append(s.pending, records...)
+	}
+	return nil
 }
 
-func (s *FileStorage) BatchSave(items map[string]string) error {
-	for key, value := range items {
-		s.urls[key] = value
+// writeRecords записывает записи журнала в w одной операцией записи.
+func writeRecords(w io.Writer, records []fileRecord) error {
+	var buf bytes.Buffer
+	encoder := json.NewEncoder(&buf)
+	for _, rec := range records {
+		if err := encoder.Encode(rec); err != nil {
+			return err
+		}
 	}
-	return s.save()
+	_, err := w.Write(buf.Bytes())
+	return err
 }
 
-func (s *FileStorage) load() error {
-	stat, err := s.file.Stat()
+// compactIfNeeded запускает сжатие журнала в фоне, если он заметно длиннее
+// актуального состояния. Вызывается под блокировкой записи. Сжатие —
+// лишь оптимизация: его ошибка не отменяет уже записанное, журнал
+// остаётся прежним, а ошибка пишется в лог.
+func (s *FileStorage) compactIfNeeded() {
+	if s.compacting || !s.needsCompaction() {
+		return
+	}
+	s.compacting = true
+	snapshot := s.snapshot()
+	s.compactions.Add(1)
+	go func() {
+		defer s.compactions.Done()
+		if err := s.compact(snapshot); err != nil {
+			s.logger.Error("failed to compact journal", zap.String("path", s.path), zap.Error(err))
+		}
+	}()
+}
+
+// needsCompaction сообщает, что журнал заметно длиннее актуального состояния.
+func (s *FileStorage) needsCompaction() bool {
+	return s.records >= compactMinRecords && s.records > 2*s.index.len()
+}
+
+// snapshot возвращает записи текущего состояния в порядке создания,
+// как в исходном журнале. Вызывается под блокировкой.
+func (s *FileStorage) snapshot() []fileRecord {
+	keys := s.index.keys()
+	records := make([]fileRecord, 0, len(keys))
+	for _, key := range keys {
+		u, _ := s.index.get(key)
+		records = append(records, newFileRecord(u))
+	}
+	return records
+}
+
+// compact записывает снимок во временный файл без блокировки, затем под
+// блокировкой дописывает в него записи, сделанные за это время,
+// и атомарно подменяет им журнал. Новый журнал открыт до подмены, поэтому
+// при любой ошибке хранилище продолжает писать в прежний.
+func (s *FileStorage) compact(snapshot []fileRecord) error {
+	tmpPath := s.path + ".tmp"
+	tmp, err := writeSnapshot(tmpPath, snapshot)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	pending := s.pending
+	s.compacting, s.pending = false, nil
+	if err != nil {
+		return err
+	}
+
+	err = writeRecords(tmp, pending)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if err == nil {
+		err = os.Rename(tmpPath, s.path)
+	}
 	if err != nil {
+		tmp.Close()
+		os.Remove(tmpPath)
 		return err
 	}
+	s.file.Close()
+	s.file = tmp
+	s.records = len(snapshot) + len(pending)
+	return nil
+}
 
-	if stat.Size() == 0 {
+// writeSnapshot записывает записи в новый файл path, сбрасывает его на диск
+// и возвращает открытым для дописывания. При ошибке файл удаляется.
+func writeSnapshot[T any](path string, records []T) (*os.File, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_TRUNC|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	writer := bufio.NewWriter(file)
+	encoder := json.NewEncoder(writer)
+	for _, rec := range records {
+		if err = encoder.Encode(rec); err != nil {
+			break
+		}
+	}
+	if err == nil {
+		err = writer.Flush()
+	}
+	if err == nil {
+		err = file.Sync()
+	}
+	if err != nil {
+		file.Close()
+		os.Remove(path)
+		return nil, err
+	}
+	return file, nil
+}
+
+// NextSequence возвращает следующий номер последовательности. Счётчик
+// хранится рядом с журналом в файле с суффиксом .seq.
+func (s *FileStorage) NextSequence(_ context.Context) (uint64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.readOnly {
+		return 0, storage.ErrReadOnly
+	}
+
+	if s.seqNext >= s.seqLimit {
+		limit := s.seqLimit + sequenceBlock
+		if err := writeFileAtomic(s.sequencePath(), []byte(strconv.FormatUint(limit, 10))); err != nil {
+			return 0, err
+		}
+		s.seqLimit = limit
+	}
+	s.seqNext++
+	return s.seqNext, nil
+}
+
+func (s *FileStorage) clicksPath() string {
+	return s.path + ".clicks"
+}
+
+// hasClickTarget сообщает, что переход относится к ссылке, которая сейчас
+// хранится под его кодом, а не к удалённой ранее ссылке с тем же кодом.
+func (s *FileStorage) hasClickTarget(c storage.Click) bool {
+	u, ok := s.index.get(c.ShortURL)
+	return ok && !c.At.Before(u.CreatedAt)
+}
+
+func (s *FileStorage) RecordClicks(_ context.Context, clicks []storage.Click) error {
+	if s.readOnly {
+		return storage.ErrReadOnly
+	}
+	s.mu.RLock()
+	known := make([]storage.Click, 0, len(clicks))
+	for _, c := range clicks {
+		if _, ok := s.index.get(c.ShortURL); ok {
+			known = append(known, c)
+		}
+	}
+	s.mu.RUnlock()
+	if len(known) == 0 {
 		return nil
 	}
+	return s.clicks.record(known)
+}
+
+func (s *FileStorage) ClickStats(_ context.Context, shortURL string, q storage.StatsQuery) (storage.ClickStats, error) {
+	return s.clicks.stats(shortURL, q), nil
+}
 
-	decoder := json.NewDecoder(s.file)
-	return decoder.Decode(&s.urls)
+func (s *FileStorage) sequencePath() string {
+	return s.path + ".seq"
+}
+
+func (s *FileStorage) loadSequence() error {
+	data, err := os.ReadFile(s.sequencePath())
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	limit, err := strconv.ParseUint(strings.TrimSpace(string(data)), 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid sequence file: %w", err)
+	}
+	s.seqNext, s.seqLimit = limit, limit
+	return nil
 }
 
-func (s *FileStorage) save() error {
-	if err := s.file.Truncate(0); err != nil {
+// writeFileAtomic записывает данные во временный файл и переименовывает его,
+// чтобы при падении на диске осталась либо старая, либо новая версия.
+func writeFileAtomic(path string, data []byte) error {
+	tmpPath := path + ".tmp"
+	tmp, err := os.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
 		return err
 	}
-	if _, err := s.file.Seek(0, 0); err != nil {
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
 		return err
 	}
-	encoder := json.NewEncoder(s.file)
-	return encoder.Encode(s.urls)
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, path)
 }
 
+// Close дожидается фонового сжатия, сбрасывает журнал на диск и закрывает файл.
 func (s *FileStorage) Close() error {
-	return s.file.Close()
+	s.compactions.Wait()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	clicksErr := s.clicks.close()
+	if s.readOnly {
+		return s.file.Close()
+	}
+	if err := s.file.Sync(); err != nil {
+		s.file.Close()
+		return err
+	}
+	if err := s.file.Close(); err != nil {
+		return err
+	}
+	return clicksErr
 }
 
 func (s *FileStorage) Ping(ctx context.Context) error {
 	return nil
 }
 
+// MemoryStorage безопасно для конкурентного использования.
 type MemoryStorage struct {
-	urls map[string]string
+	mu     sync.RWMutex
+	index  *urlIndex
+	clicks *clickLog
+	seq    atomic.Uint64
 }
 
 func NewMemoryStorage() *MemoryStorage {
 	return &MemoryStorage{
-		urls: make(map[string]string),
+		index:  newURLIndex(),
+		clicks: newClickLog(),
 	}
 }
 
-func (s *MemoryStorage) Get(key string) (string, bool) {
-	val, ok := s.urls[key]
-	return val, ok
+func (s *MemoryStorage) Get(_ context.Context, key string) (storage.URL, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	u, ok := s.index.get(key)
+	if !ok {
+		return storage.URL{}, storage.ErrNotFound
+	}
+	return u, nil
 }
 
-func (s *MemoryStorage) Save(key, value string) (string, bool, error) {
-	if existingKey, ok := s.getKeyByValue(value); ok {
-		return existingKey, false, nil
+func (s *MemoryStorage) Save(_ context.Context, u storage.URL) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	if existingKey, ok := s.index.liveKeyOf(u.OriginalURL, now); ok {
+		return existingKey, &storage.ConflictError{ShortURL: existingKey}
+	}
+	if _, ok := s.index.get(u.ShortURL); ok {
+		return "", storage.ErrCodeTaken
+	}
+	if u.CreatedAt.IsZero() {
+		u.CreatedAt = now
 	}
-	s.urls[key] = value
-	return key, true, nil
+	s.index.put(u)
+	return u.ShortURL, nil
 }
 
-func (s *MemoryStorage) GetByOriginalURL(originalURL string) (string, bool) {
-	for key, value := range s.urls {
-		if value == originalURL {
-			return key, true
-		}
+func (s *MemoryStorage) GetByOriginalURL(_ context.Context, originalURL string) (string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	key, ok := s.index.liveKeyOf(originalURL, time.Now())
+	if !ok {
+		return "", storage.ErrNotFound
 	}
-	return "", false
+	return key, nil
 }
 
-func (s *MemoryStorage) getKeyByValue(value string) (string, bool) {
-	for key, val := range s.urls {
-		if val == value {
-			return key, true
-		}
+func (s *MemoryStorage) BatchSave(_ context.Context, items []storage.URL) ([]storage.SaveResult, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	results, fresh, err := s.index.batch(items, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	for _, u := range fresh {
+		s.index.put(u)
 	}
-	return "", false
+	return results, nil
+}
+
+func (s *MemoryStorage) GetUserURLs(_ context.Context, userID string) ([]storage.URL, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.index.byUser(userID, time.Now()), nil
 }
 
-func (s *MemoryStorage) BatchSave(items map[string]string) error {
-	for key, value := range items {
-		s.urls[key] = value
+func (s *MemoryStorage) DeleteURLs(_ context.Context, items []storage.DeleteRequest) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, u := range s.index.deletable(items) {
+		s.index.put(u)
 	}
 	return nil
 }
 
+func (s *MemoryStorage) DeleteExpired(_ context.Context, now time.Time) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	keys := s.index.expired(now)
+	for _, key := range keys {
+		s.index.remove(key)
+	}
+	s.clicks.drop(keys)
+	return len(keys), nil
+}
+
+func (s *MemoryStorage) RecordClicks(_ context.Context, clicks []storage.Click) error {
+	s.mu.RLock()
+	known := make([]storage.Click, 0, len(clicks))
+	for _, c := range clicks {
+		if _, ok := s.index.get(c.ShortURL); ok {
+			known = append(known, c)
+		}
+	}
+	s.mu.RUnlock()
+	return s.clicks.record(known)
+}
+
+func (s *MemoryStorage) ClickStats(_ context.Context, shortURL string, q storage.StatsQuery) (storage.ClickStats, error) {
+	return s.clicks.stats(shortURL, q), nil
+}
+
+func (s *MemoryStorage) ForEach(ctx context.Context, fn func(storage.URL) error) error {
+	return forEachSnapshot(ctx, &s.mu, s.index, fn)
+}
+
+func (s *MemoryStorage) Count(_ context.Context) (int, error) {
+	return s.indexSize(), nil
+}
+
+// indexSize возвращает число ссылок хранилища: кроме индекса, они
+// нигде не хранятся.
+func (s *MemoryStorage) indexSize() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.index.len()
+}
+
+func (s *MemoryStorage) NextSequence(_ context.Context) (uint64, error) {
+	return s.seq.Add(1), nil
+}
+
 func (s *MemoryStorage) Close() error {
 	return nil
 }
@@ -167,3 +797,38 @@ func (s *MemoryStorage) Close() error {
 func (s *MemoryStorage) Ping(ctx context.Context) error {
 	return nil
 }
+
+// forEachSnapshot обходит ссылки index по снимку их кодов, снятому в начале
+// обхода: ссылки, созданные позже, не попадают в обход, а удалённые
+// за время обхода пропускаются. Ссылки читаются страницами под разделяемой
+// блокировкой, а fn вызывается без неё, чтобы медленный получатель
+// не задерживал запись.
+func forEachSnapshot(ctx context.Context, mu *sync.RWMutex, index *urlIndex, fn func(storage.URL) error) error {
+	mu.RLock()
+	keys := index.keys()
+	mu.RUnlock()
+
+	page := make([]storage.URL, 0, iteratePageSize)
+	for start := 0; start < len(keys); start += iteratePageSize {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		end := min(start+iteratePageSize, len(keys))
+
+		page = page[:0]
+		mu.RLock()
+		for _, key := range keys[start:end] {
+			if u, ok := index.get(key); ok {
+				page = append(page, u)
+			}
+		}
+		mu.RUnlock()
+
+		for _, u := range page {
+			if err := fn(u); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
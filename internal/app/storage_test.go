@@ -0,0 +1,705 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/vvityuk/shortener/internal/config"
+	appstorage "github.com/vvityuk/shortener/internal/storage"
+	"github.com/vvityuk/shortener/internal/storage/postgres"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+func TestFileStorageJournal(t *testing.T) {
+	// Тест повтора журнала после перезапуска
+	t.Run("Replay", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "urls.json")
+
+		storage, err := NewStorage(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := storage.Save(context.Background(), appstorage.URL{ShortURL: "abcd", OriginalURL: "https://ya.ru"}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := storage.BatchSave(context.Background(), []appstorage.URL{{ShortURL: "efgh", OriginalURL: "https://example.com"}}); err != nil {
+			t.Fatal(err)
+		}
+		storage.Close()
+
+		storage, err = NewStorage(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer storage.Close()
+
+		if val, err := storage.Get(context.Background(), "abcd"); err != nil || val.OriginalURL != "https://ya.ru" {
+			t.Errorf("Expected https://ya.ru, got %q", val.OriginalURL)
+		}
+		if val, err := storage.Get(context.Background(), "efgh"); err != nil || val.OriginalURL != "https://example.com" {
+			t.Errorf("Expected https://example.com, got %q", val.OriginalURL)
+		}
+	})
+
+	// Тест недописанной последней строки
+	t.Run("Torn last line", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "urls.json")
+		data := `{"short_url":"abcd","original_url":"https://ya.ru"}` + "\n" + `{"short_url":"ef`
+		if err := os.WriteFile(path, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		storage, err := NewStorage(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := storage.Get(context.Background(), "abcd"); err != nil {
+			t.Error("Expected abcd to be loaded")
+		}
+		if _, err := storage.Save(context.Background(), appstorage.URL{ShortURL: "ijkl", OriginalURL: "https://example.com"}); err != nil {
+			t.Fatal(err)
+		}
+		storage.Close()
+
+		storage, err = NewStorage(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer storage.Close()
+		if _, err := storage.Get(context.Background(), "ijkl"); err != nil {
+			t.Error("Expected ijkl to survive restart")
+		}
+	})
+
+	// Тест повреждённой записи в середине журнала
+	t.Run("Corrupted record", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "urls.json")
+		data := "garbage\n" + `{"short_url":"abcd","original_url":"https://ya.ru"}` + "\n"
+		if err := os.WriteFile(path, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := NewStorage(path); err == nil {
+			t.Error("Expected error for corrupted journal")
+		}
+	})
+
+	// Тест чтения файла в старом формате
+	t.Run("Legacy snapshot", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "urls.json")
+		if err := os.WriteFile(path, []byte(`{"abcd":"https://ya.ru","efgh":"https://example.com"}`+"\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		storage, err := NewStorage(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		storage.Close()
+
+		storage, err = NewStorage(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer storage.Close()
+		if val, err := storage.Get(context.Background(), "efgh"); err != nil || val.OriginalURL != "https://example.com" {
+			t.Errorf("Expected https://example.com, got %q", val.OriginalURL)
+		}
+		if storage.records != 2 {
+			t.Errorf("Expected journal with 2 records, got %d", storage.records)
+		}
+	})
+
+	// Тест сжатия журнала
+	t.Run("Compaction", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "urls.json")
+
+		// Многократные записи одного и того же кода раздувают журнал
+		line := `{"short_url":"abcd","original_url":"https://ya.ru"}` + "\n"
+		if err := os.WriteFile(path, []byte(strings.Repeat(line, compactMinRecords*2)), 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		storage, err := NewStorage(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer storage.Close()
+
+		if storage.records != 1 {
+			t.Errorf("Expected journal to be compacted to 1 record, got %d", storage.records)
+		}
+		if val, err := storage.Get(context.Background(), "abcd"); err != nil || val.OriginalURL != "https://ya.ru" {
+			t.Errorf("Expected https://ya.ru, got %q", val.OriginalURL)
+		}
+	})
+}
+
+func TestStorageConcurrency(t *testing.T) {
+	fileStorage, err := NewStorage(filepath.Join(t.TempDir(), "urls.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fileStorage.Close()
+
+	storages := map[string]Storage{
+		"memory": NewMemoryStorage(),
+		"file":   fileStorage,
+	}
+
+	for name, storage := range storages {
+		t.Run(name, func(t *testing.T) {
+			const workers = 16
+			const perWorker = 100
+
+			var wg sync.WaitGroup
+			for w := 0; w < workers; w++ {
+				wg.Add(3)
+				go func() {
+					defer wg.Done()
+					for i := 0; i < perWorker; i++ {
+						key := fmt.Sprintf("s%d-%d", w, i)
+						if _, err := storage.Save(context.Background(), appstorage.URL{ShortURL: key, OriginalURL: "https://example.com/" + key}); err != nil {
+							t.Error(err)
+							return
+						}
+					}
+				}()
+				go func() {
+					defer wg.Done()
+					for i := 0; i < perWorker; i++ {
+						key := fmt.Sprintf("b%d-%d", w, i)
+						if _, err := storage.BatchSave(context.Background(), []appstorage.URL{{ShortURL: key, OriginalURL: "https://example.com/" + key}}); err != nil {
+							t.Error(err)
+							return
+						}
+					}
+				}()
+				go func() {
+					defer wg.Done()
+					for i := 0; i < perWorker; i++ {
+						storage.Get(context.Background(), fmt.Sprintf("s%d-%d", w, i))
+						storage.GetByOriginalURL(context.Background(), fmt.Sprintf("https://example.com/b%d-%d", w, i))
+					}
+				}()
+			}
+			wg.Wait()
+
+			for w := 0; w < workers; w++ {
+				for i := 0; i < perWorker; i++ {
+					for _, prefix := range []string{"s", "b"} {
+						key := fmt.Sprintf("%s%d-%d", prefix, w, i)
+						if val, err := storage.Get(context.Background(), key); err != nil || val.OriginalURL != "https://example.com/"+key {
+							t.Fatalf("Expected %s to be stored, got %q", key, val.OriginalURL)
+						}
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestURLIndex(t *testing.T) {
+	storage := NewMemoryStorage()
+
+	if _, err := storage.Save(context.Background(), appstorage.URL{ShortURL: "abcd", OriginalURL: "https://ya.ru"}); err != nil {
+		t.Fatal(err)
+	}
+	if key, err := storage.Save(context.Background(), appstorage.URL{ShortURL: "efgh", OriginalURL: "https://ya.ru"}); !errors.Is(err, appstorage.ErrConflict) || key != "abcd" {
+		t.Errorf("Expected existing key abcd, got %q (err: %v)", key, err)
+	}
+
+	// Перезапись кода другим URL должна убрать старую обратную запись
+	idx := newURLIndex()
+	idx.put(appstorage.URL{ShortURL: "abcd", OriginalURL: "https://ya.ru"})
+	idx.put(appstorage.URL{ShortURL: "abcd", OriginalURL: "https://example.com"})
+	if _, ok := idx.liveKeyOf("https://ya.ru", time.Now()); ok {
+		t.Error("Expected https://ya.ru to be unindexed")
+	}
+	if key, ok := idx.liveKeyOf("https://example.com", time.Now()); !ok || key != "abcd" {
+		t.Errorf("Expected key abcd, got %q", key)
+	}
+
+	// Удалённая ссылка не вытесняет действующую на тот же URL
+	idx.put(appstorage.URL{ShortURL: "efgh", OriginalURL: "https://example.com", Deleted: true})
+	if key, ok := idx.liveKeyOf("https://example.com", time.Now()); !ok || key != "abcd" {
+		t.Errorf("Expected live key abcd, got %q", key)
+	}
+}
+
+func TestFileStorageCompactionKeepsLiveLink(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "urls.json")
+	storage, err := NewStorage(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	created := time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC)
+
+	// Много удалённых ссылок и одна живая на тот же URL: при записи снимка
+	// в порядке обхода map живая ссылка почти наверняка оказалась бы
+	// не последней
+	for i := 0; i < 50; i++ {
+		key := fmt.Sprintf("dead%02d", i)
+		if _, err := storage.Save(ctx, appstorage.URL{ShortURL: key, OriginalURL: "https://ya.ru", UserID: "u", CreatedAt: created.Add(time.Duration(i) * time.Minute)}); err != nil {
+			t.Fatal(err)
+		}
+		if err := storage.DeleteURLs(ctx, []appstorage.DeleteRequest{{UserID: "u", ShortURL: key}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := storage.Save(ctx, appstorage.URL{ShortURL: "bbb", OriginalURL: "https://ya.ru", CreatedAt: created.Add(time.Hour)}); err != nil {
+		t.Fatal(err)
+	}
+	if err := compactNow(storage); err != nil {
+		t.Fatal(err)
+	}
+	storage.Close()
+
+	storage, err = NewStorage(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer storage.Close()
+	if key, err := storage.Save(ctx, appstorage.URL{ShortURL: "ccc", OriginalURL: "https://ya.ru"}); !errors.Is(err, appstorage.ErrConflict) || key != "bbb" {
+		t.Errorf("Expected conflict with live link bbb, got %q (err: %v)", key, err)
+	}
+}
+
+// compactNow сжимает журнал storage синхронно.
+func compactNow(storage *FileStorage) error {
+	storage.mu.Lock()
+	storage.compacting = true
+	snapshot := storage.snapshot()
+	storage.mu.Unlock()
+	return storage.compact(snapshot)
+}
+
+func TestFileStorageBackgroundCompaction(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("Writes during compaction", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "urls.json")
+		storage, err := NewStorage(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := storage.Save(ctx, appstorage.URL{ShortURL: "aaa", OriginalURL: "https://ya.ru"}); err != nil {
+			t.Fatal(err)
+		}
+
+		// Ссылка сохраняется, пока снимок пишется без блокировки
+		storage.mu.Lock()
+		storage.compacting = true
+		snapshot := storage.snapshot()
+		storage.mu.Unlock()
+		if _, err := storage.Save(ctx, appstorage.URL{ShortURL: "bbb", OriginalURL: "https://go.dev"}); err != nil {
+			t.Fatal(err)
+		}
+		if err := storage.compact(snapshot); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := storage.Save(ctx, appstorage.URL{ShortURL: "ccc", OriginalURL: "https://example.com"}); err != nil {
+			t.Fatal(err)
+		}
+		storage.Close()
+
+		storage, err = NewStorage(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer storage.Close()
+		for _, key := range []string{"aaa", "bbb", "ccc"} {
+			if _, err := storage.Get(ctx, key); err != nil {
+				t.Errorf("Expected %s to survive compaction, got %v", key, err)
+			}
+		}
+	})
+
+	t.Run("Failure keeps the journal", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "urls.json")
+		// Каталог на месте временного файла не даёт записать снимок
+		if err := os.Mkdir(path+".tmp", 0755); err != nil {
+			t.Fatal(err)
+		}
+		// Многократные записи одного кода раздувают журнал
+		line := `{"short_url":"abcd","original_url":"https://ya.ru"}` + "\n"
+		if err := os.WriteFile(path, []byte(strings.Repeat(line, compactMinRecords*2)), 0644); err != nil {
+			t.Fatal(err)
+		}
+		core, logs := observer.New(zap.ErrorLevel)
+		storage, err := OpenFileStorage(path, FileOptions{Logger: zap.New(core)})
+		if err != nil {
+			t.Fatalf("Expected storage to open despite compaction failure, got %v", err)
+		}
+
+		// Сжатие снова запускается после записи и снова не удаётся
+		if _, err := storage.Save(ctx, appstorage.URL{ShortURL: "last", OriginalURL: "https://go.dev"}); err != nil {
+			t.Fatalf("Expected save to succeed despite compaction failure, got %v", err)
+		}
+		storage.compactions.Wait()
+		if n := logs.FilterMessage("failed to compact journal").Len(); n != 2 {
+			t.Errorf("Expected 2 compaction failures to be logged, got %d", n)
+		}
+		if _, err := storage.Save(ctx, appstorage.URL{ShortURL: "more", OriginalURL: "https://example.com"}); err != nil {
+			t.Fatal(err)
+		}
+		storage.Close()
+
+		os.Remove(path + ".tmp")
+		storage, err = NewStorage(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer storage.Close()
+		for _, key := range []string{"abcd", "last", "more"} {
+			if _, err := storage.Get(ctx, key); err != nil {
+				t.Errorf("Expected %s to be kept in the journal, got %v", key, err)
+			}
+		}
+	})
+}
+
+func TestStorageCodeTaken(t *testing.T) {
+	storage := NewMemoryStorage()
+	if _, err := storage.Save(context.Background(), appstorage.URL{ShortURL: "abcd", OriginalURL: "https://ya.ru"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := storage.Save(context.Background(), appstorage.URL{ShortURL: "abcd", OriginalURL: "https://example.com"}); !errors.Is(err, appstorage.ErrCodeTaken) {
+		t.Errorf("Expected ErrCodeTaken, got %v", err)
+	}
+
+	_, err := storage.BatchSave(context.Background(), []appstorage.URL{
+		{ShortURL: "efgh", OriginalURL: "https://example.com"},
+		{ShortURL: "abcd", OriginalURL: "https://example.org"},
+	})
+	if !errors.Is(err, appstorage.ErrCodeTaken) {
+		t.Errorf("Expected ErrCodeTaken, got %v", err)
+	}
+	if _, err := storage.Get(context.Background(), "efgh"); !errors.Is(err, appstorage.ErrNotFound) {
+		t.Error("Expected batch to be rejected as a whole")
+	}
+	if val, _ := storage.Get(context.Background(), "abcd"); val.OriginalURL != "https://ya.ru" {
+		t.Errorf("Expected abcd to keep https://ya.ru, got %q", val.OriginalURL)
+	}
+}
+
+func TestStorageBatchDedup(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "urls.json")
+	fileStorage, err := NewStorage(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fileStorage.Close()
+
+	storages := map[string]Storage{
+		"memory": NewMemoryStorage(),
+		"file":   fileStorage,
+	}
+
+	for name, storage := range storages {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			if _, err := storage.Save(ctx, appstorage.URL{ShortURL: "abcd", OriginalURL: "https://ya.ru"}); err != nil {
+				t.Fatal(err)
+			}
+
+			results, err := storage.BatchSave(ctx, []appstorage.URL{
+				{ShortURL: "efgh", OriginalURL: "https://ya.ru"},
+				{ShortURL: "ijkl", OriginalURL: "https://example.com"},
+				{ShortURL: "mnop", OriginalURL: "https://example.com"},
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			expected := []appstorage.SaveResult{
+				{ShortURL: "abcd", Existing: true},
+				{ShortURL: "ijkl"},
+				{ShortURL: "ijkl", Existing: true},
+			}
+			for i := range expected {
+				if results[i] != expected[i] {
+					t.Errorf("Expected result %d to be %+v, got %+v", i, expected[i], results[i])
+				}
+			}
+			for _, key := range []string{"efgh", "mnop"} {
+				if _, err := storage.Get(ctx, key); !errors.Is(err, appstorage.ErrNotFound) {
+					t.Errorf("Expected duplicate %s not to be stored, got %v", key, err)
+				}
+			}
+		})
+	}
+
+	// В журнал попадают только новые ссылки
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lines := strings.Count(string(data), "\n"); lines != 2 {
+		t.Errorf("Expected 2 journal records, got %d", lines)
+	}
+}
+
+func TestStorageForEach(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "urls.json")
+	fileStorage, err := NewStorage(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fileStorage.Close()
+
+	storages := map[string]Storage{
+		"memory": NewMemoryStorage(),
+		"file":   fileStorage,
+	}
+
+	const n = iteratePageSize*2 + 1
+	created := time.Now().Add(-time.Hour)
+	for name, storage := range storages {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			items := make([]appstorage.URL, 0, n)
+			for i := 0; i < n; i++ {
+				items = append(items, appstorage.URL{
+					ShortURL:    fmt.Sprintf("k%d", i),
+					OriginalURL: fmt.Sprintf("https://example.com/%d", i),
+					CreatedAt:   created.Add(time.Duration(n-i) * time.Second),
+				})
+			}
+			if _, err := storage.BatchSave(ctx, items); err != nil {
+				t.Fatal(err)
+			}
+
+			var visited []appstorage.URL
+			err := storage.ForEach(ctx, func(u appstorage.URL) error {
+				// Обход не держит блокировку, пока работает fn
+				if len(visited) == 0 {
+					if _, err := storage.Save(ctx, appstorage.URL{ShortURL: "later", OriginalURL: "https://later.example.com"}); err != nil {
+						return err
+					}
+				}
+				visited = append(visited, u)
+				return nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(visited) != n {
+				t.Fatalf("Expected %d links from the snapshot, got %d", n, len(visited))
+			}
+			// Порядок — по времени создания
+			if visited[0].ShortURL != fmt.Sprintf("k%d", n-1) || !visited[0].CreatedAt.Equal(items[n-1].CreatedAt) {
+				t.Errorf("Expected the oldest link first, got %+v", visited[0])
+			}
+
+			stop := errors.New("stop")
+			calls := 0
+			err = storage.ForEach(ctx, func(appstorage.URL) error {
+				calls++
+				return stop
+			})
+			if !errors.Is(err, stop) || calls != 1 {
+				t.Errorf("Expected fn error to stop iteration, got %v after %d calls", err, calls)
+			}
+		})
+	}
+}
+
+// fillStorage сохраняет в storage n ссылок на разные URL.
+func fillStorage(b *testing.B, storage Storage, n int) {
+	b.Helper()
+	items := make([]appstorage.URL, 0, n)
+	for i := 0; i < n; i++ {
+		items = append(items, appstorage.URL{ShortURL: fmt.Sprintf("k%d", i), OriginalURL: fmt.Sprintf("https://example.com/%d", i)})
+	}
+	if _, err := storage.BatchSave(context.Background(), items); err != nil {
+		b.Fatal(err)
+	}
+}
+
+// openBenchFileStorage открывает файловое хранилище во временном каталоге.
+func openBenchFileStorage(b *testing.B) Storage {
+	b.Helper()
+	storage, err := NewStorage(filepath.Join(b.TempDir(), "urls.json"))
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.Cleanup(func() { storage.Close() })
+	return storage
+}
+
+func openBenchMemoryStorage(*testing.B) Storage {
+	return NewMemoryStorage()
+}
+
+// benchmarkSizes — размеры хранилища в бенчмарках поиска дублей: время
+// операции не должно расти вместе с числом ссылок.
+var benchmarkSizes = []int{1_000, 100_000, 1_000_000}
+
+func benchmarkSaveExisting(b *testing.B, open func(*testing.B) Storage) {
+	for _, size := range benchmarkSizes {
+		b.Run(fmt.Sprintf("size=%d", size), func(b *testing.B) {
+			storage := open(b)
+			fillStorage(b, storage, size)
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err := storage.Save(context.Background(), appstorage.URL{ShortURL: "new", OriginalURL: fmt.Sprintf("https://example.com/%d", i%size)}); !errors.Is(err, appstorage.ErrConflict) {
+					b.Fatal("Expected existing URL")
+				}
+			}
+		})
+	}
+}
+
+func benchmarkGetByOriginalURL(b *testing.B, open func(*testing.B) Storage) {
+	for _, size := range benchmarkSizes {
+		b.Run(fmt.Sprintf("size=%d", size), func(b *testing.B) {
+			storage := open(b)
+			fillStorage(b, storage, size)
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err := storage.GetByOriginalURL(context.Background(), fmt.Sprintf("https://example.com/%d", i%size)); err != nil {
+					b.Fatal("Expected URL to be found")
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkMemoryStorageSaveExisting(b *testing.B) {
+	benchmarkSaveExisting(b, openBenchMemoryStorage)
+}
+
+func BenchmarkMemoryStorageGetByOriginalURL(b *testing.B) {
+	benchmarkGetByOriginalURL(b, openBenchMemoryStorage)
+}
+
+// Файловое хранилище добавляет к поиску блокировки и журнал
+func BenchmarkFileStorageSaveExisting(b *testing.B) {
+	benchmarkSaveExisting(b, openBenchFileStorage)
+}
+
+func BenchmarkFileStorageGetByOriginalURL(b *testing.B) {
+	benchmarkGetByOriginalURL(b, openBenchFileStorage)
+}
+
+func TestFileStorageSequence(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "urls.json")
+	storage, err := NewStorage(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	first, err := storage.NextSequence(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	storage.Close()
+
+	storage, err = NewStorage(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer storage.Close()
+	next, err := storage.NextSequence(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if next <= first {
+		t.Errorf("Expected sequence to grow across restarts, got %d after %d", next, first)
+	}
+}
+
+func TestStorageExpiration(t *testing.T) {
+	fileStorage, err := NewStorage(filepath.Join(t.TempDir(), "urls.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fileStorage.Close()
+
+	storages := map[string]Storage{
+		"memory": NewMemoryStorage(),
+		"file":   fileStorage,
+	}
+
+	for name, storage := range storages {
+		t.Run(name, func(t *testing.T) {
+			past := time.Now().Add(-time.Minute)
+			if _, err := storage.Save(context.Background(), appstorage.URL{ShortURL: "old1", OriginalURL: "https://ya.ru", ExpiresAt: past}); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := storage.Save(context.Background(), appstorage.URL{ShortURL: "live", OriginalURL: "https://example.com"}); err != nil {
+				t.Fatal(err)
+			}
+
+			// Истёкшая ссылка не мешает сократить тот же URL заново
+			key, err := storage.Save(context.Background(), appstorage.URL{ShortURL: "new1", OriginalURL: "https://ya.ru"})
+			if err != nil || key != "new1" {
+				t.Fatalf("Expected new1 to replace the expired link, got %q (err: %v)", key, err)
+			}
+
+			n, err := storage.DeleteExpired(context.Background(), time.Now())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if n != 1 {
+				t.Errorf("Expected 1 expired link, got %d", n)
+			}
+			if _, err := storage.Get(context.Background(), "old1"); !errors.Is(err, appstorage.ErrNotFound) {
+				t.Error("Expected old1 to be deleted")
+			}
+			if key, err := storage.GetByOriginalURL(context.Background(), "https://ya.ru"); err != nil || key != "new1" {
+				t.Errorf("Expected https://ya.ru to map to new1, got %q", key)
+			}
+		})
+	}
+
+	// Удаление переживает перезапуск файлового хранилища
+	fileStorage.Close()
+	fileStorage, err = NewStorage(fileStorage.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fileStorage.Close()
+	if _, err := fileStorage.Get(context.Background(), "old1"); !errors.Is(err, appstorage.ErrNotFound) {
+		t.Error("Expected old1 to stay deleted after restart")
+	}
+	if _, err := fileStorage.Get(context.Background(), "new1"); err != nil {
+		t.Error("Expected new1 to survive restart")
+	}
+}
+
+// testStorages открывает хранилища всех видов. Postgres участвует, только
+// если в TEST_DATABASE_DSN задана тестовая база.
+func testStorages(t *testing.T) map[string]Storage {
+	t.Helper()
+	fileStorage, err := NewStorage(filepath.Join(t.TempDir(), "urls.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { fileStorage.Close() })
+
+	storages := map[string]Storage{
+		"memory": NewMemoryStorage(),
+		"file":   fileStorage,
+	}
+	if dsn := os.Getenv("TEST_DATABASE_DSN"); dsn != "" {
+		pgStorage, err := postgres.New(dsn, PoolOptions(&config.Config{}))
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { pgStorage.Close() })
+		storages["postgres"] = pgStorage
+	}
+	return storages
+}
@@ -0,0 +1,210 @@
+package app
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+
+	"github.com/vvityuk/shortener/internal/app/middleware"
+)
+
+const (
+	// streamChunkSize — сколько строк импорта сохраняется одним вызовом BatchSave.
+	streamChunkSize = 500
+	// maxStreamLineSize — предельная длина одной строки импорта.
+	maxStreamLineSize = 64 << 10
+)
+
+// Типы строк ответа потокового импорта.
+const (
+	streamTypeResult   = "result"
+	streamTypeProgress = "progress"
+	streamTypeDone     = "done"
+	streamTypeError    = "error"
+)
+
+// Коды ошибок строк импорта.
+const (
+	batchErrInvalidJSON = "invalid_json"
+	batchErrLineTooLong = "line_too_long"
+	// streamErrAborted — импорт прерван, следующие строки не обработаны.
+	streamErrAborted = "aborted"
+)
+
+// streamResult — результат одной строки импорта. Line — номер строки
+// запроса, начиная с единицы.
+type streamResult struct {
+	Type string `json:"type"`
+	Line int    `json:"line"`
+	batchResponse
+}
+
+// streamProgress — счётчики обработанных строк, отправляются после
+// каждой порции и в конце импорта.
+type streamProgress struct {
+	Type      string `json:"type"`
+	Processed int    `json:"processed"`
+	Created   int    `json:"created"`
+	Existing  int    `json:"existing"`
+	Invalid   int    `json:"invalid"`
+}
+
+// streamError завершает ответ, если импорт прерван после начала передачи.
+type streamError struct {
+	Type  string     `json:"type"`
+	Error batchError `json:"error"`
+}
+
+// StreamShortenURL импортирует ссылки из тела в формате NDJSON: по одному
+// объекту batchRequest на строку. Строки обрабатываются порциями по
+// streamChunkSize, результаты каждой порции сразу отправляются клиенту
+// строками NDJSON, так что ни запрос, ни ответ целиком в памяти не хранятся.
+// correlation_id в импорте необязателен: результаты сопоставляются
+// по номеру строки.
+func (h *Handler) StreamShortenURL(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediaType != "application/x-ndjson" && mediaType != "application/ndjson" {
+		writeJSONError(w, http.StatusUnsupportedMediaType, "request body must be application/x-ndjson")
+		return
+	}
+
+	// В HTTP/1.x без этого тело запроса может стать недоступным после
+	// первой отправленной порции ответа
+	rc := http.NewResponseController(w)
+	rc.EnableFullDuplex()
+
+	reader := bufio.NewReaderSize(r.Body, maxStreamLineSize)
+	encoder := json.NewEncoder(w)
+	started := false
+	start := func() {
+		if !started {
+			w.Header().Set("Content-Type", "application/x-ndjson")
+			w.WriteHeader(http.StatusOK)
+			started = true
+		}
+	}
+	// fail сообщает о фатальной ошибке импорта: пока ответ не начат —
+	// статусом, иначе — завершающей строкой NDJSON
+	fail := func(status int, message string) {
+		if !started {
+			writeJSONError(w, status, message)
+			return
+		}
+		encoder.Encode(streamError{Type: streamTypeError, Error: batchError{Code: streamErrAborted, Message: message}})
+	}
+
+	var progress streamProgress
+	lineNo := 0
+	req := make([]batchRequest, 0, streamChunkSize)
+	resp := make([]streamResult, 0, streamChunkSize)
+	items := make([]batchResponse, 0, streamChunkSize)
+
+	flush := func() error {
+		if len(req) == 0 {
+			return nil
+		}
+		items = items[:0]
+		for i := range resp {
+			items = append(items, resp[i].batchResponse)
+		}
+		if err := h.shortenBatch(r.Context(), req, items); err != nil {
+			return err
+		}
+
+		start()
+		for i := range resp {
+			resp[i].batchResponse = items[i]
+			encoder.Encode(resp[i])
+			progress.add(items[i])
+		}
+		progress.Type = streamTypeProgress
+		encoder.Encode(progress)
+		rc.Flush()
+
+		req, resp = req[:0], resp[:0]
+		return nil
+	}
+
+	for {
+		line, tooLong, err := readLine(reader)
+		if err != nil && !errors.Is(err, io.EOF) {
+			var maxErr *http.MaxBytesError
+			if errors.As(err, &maxErr) || errors.Is(err, middleware.ErrMalformedBody) {
+				fail(errorStatus(err))
+			} else {
+				fail(http.StatusBadRequest, "failed to read request body")
+			}
+			return
+		}
+		if len(line) > 0 || tooLong {
+			lineNo++
+			item := streamResult{Type: streamTypeResult, Line: lineNo}
+			var rec batchRequest
+			if tooLong {
+				item.reject(batchErrLineTooLong, fmt.Sprintf("line exceeds %d bytes", maxStreamLineSize))
+			} else if decodeErr := json.Unmarshal(line, &rec); decodeErr != nil {
+				item.reject(batchErrInvalidJSON, decodeErr.Error())
+			}
+			item.CorrelationID = rec.CorrelationID
+			req = append(req, rec)
+			resp = append(resp, item)
+		}
+
+		if len(req) == streamChunkSize || errors.Is(err, io.EOF) {
+			if flushErr := flush(); flushErr != nil {
+				fail(errorStatus(flushErr))
+				return
+			}
+		}
+		if errors.Is(err, io.EOF) {
+			break
+		}
+	}
+
+	if lineNo == 0 {
+		writeJSONError(w, http.StatusBadRequest, "empty import")
+		return
+	}
+	progress.Type = streamTypeDone
+	encoder.Encode(progress)
+}
+
+// add учитывает результат строки в счётчиках.
+func (p *streamProgress) add(item batchResponse) {
+	p.Processed++
+	switch item.Status {
+	case BatchCreated:
+		p.Created++
+	case BatchExisting:
+		p.Existing++
+	case BatchInvalid:
+		p.Invalid++
+	}
+}
+
+// readLine читает следующую строку без завершающего перевода строки.
+// Пустые строки пропускаются. Строка длиннее буфера reader дочитывается
+// и отбрасывается, а tooLong сообщает об этом.
+func readLine(reader *bufio.Reader) (line []byte, tooLong bool, err error) {
+	for {
+		line, err = reader.ReadSlice('\n')
+		for errors.Is(err, bufio.ErrBufferFull) {
+			tooLong = true
+			_, err = reader.ReadSlice('\n')
+		}
+		if tooLong {
+			return nil, true, err
+		}
+		line = bytes.TrimSpace(line)
+		if len(line) > 0 || err != nil {
+			return line, false, err
+		}
+	}
+}
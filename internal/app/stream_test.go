@@ -0,0 +1,173 @@
+package app
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/vvityuk/shortener/internal/app/middleware"
+	"github.com/vvityuk/shortener/internal/config"
+	"go.uber.org/zap"
+)
+
+// streamLine — строка ответа импорта с полями всех типов.
+type streamLine struct {
+	streamResult
+	Processed int `json:"processed"`
+	Created   int `json:"created"`
+	Existing  int `json:"existing"`
+	Invalid   int `json:"invalid"`
+}
+
+func readStream(t *testing.T, body *bytes.Buffer) []streamLine {
+	t.Helper()
+	var lines []streamLine
+	scanner := bufio.NewScanner(body)
+	for scanner.Scan() {
+		var line streamLine
+		if err := json.Unmarshal(scanner.Bytes(), &line); err != nil {
+			t.Fatalf("Invalid response line %q: %v", scanner.Text(), err)
+		}
+		lines = append(lines, line)
+	}
+	return lines
+}
+
+func TestStreamShortenURL(t *testing.T) {
+	service, err := newService(NewMemoryStorage(), &config.Config{BaseURL: "http://localhost:8080"}, zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer service.Close()
+	handler := NewHandler(service)
+
+	t.Run("Per-line results", func(t *testing.T) {
+		body := strings.Join([]string{
+			`{"correlation_id":"1","original_url":"https://stream.example.com"}`,
+			``,
+			`{"original_url":"https://stream.example.com"}`,
+			`not json`,
+			`{"original_url":"https://long.example.com/` + strings.Repeat("a", maxStreamLineSize) + `"}`,
+			`{"original_url":""}`,
+		}, "\n")
+		req := httptest.NewRequest(http.MethodPost, "/api/shorten/stream", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/x-ndjson")
+		w := httptest.NewRecorder()
+		handler.StreamShortenURL(w, req)
+
+		if w.Code != http.StatusOK {
+			t.Fatalf("Expected status %d, got %d", http.StatusOK, w.Code)
+		}
+		lines := readStream(t, w.Body)
+		expected := []struct {
+			status BatchStatus
+			code   string
+		}{
+			{BatchCreated, ""},
+			{BatchExisting, ""},
+			{BatchInvalid, batchErrInvalidJSON},
+			{BatchInvalid, batchErrLineTooLong},
+			{BatchInvalid, batchErrInvalidURL},
+		}
+		if len(lines) != len(expected)+2 {
+			t.Fatalf("Expected %d results, progress and done, got %d lines", len(expected), len(lines))
+		}
+		for i, e := range expected {
+			line := lines[i]
+			if line.Type != streamTypeResult || line.Line != i+1 || line.Status != e.status {
+				t.Errorf("Expected line %d to be %s, got %+v", i+1, e.status, line)
+			}
+			if e.code != "" && (line.Error == nil || line.Error.Code != e.code) {
+				t.Errorf("Expected line %d to fail with %s, got %+v", i+1, e.code, line.Error)
+			}
+		}
+		if lines[0].CorrelationID != "1" || lines[0].ShortURL != lines[1].ShortURL {
+			t.Errorf("Expected repeated URL to get the same short URL, got %+v and %+v", lines[0], lines[1])
+		}
+		done := lines[len(lines)-1]
+		if done.Type != streamTypeDone || done.Processed != 5 || done.Created != 1 || done.Existing != 1 || done.Invalid != 3 {
+			t.Errorf("Unexpected final progress %+v", done)
+		}
+	})
+
+	t.Run("Chunks and gzip", func(t *testing.T) {
+		const n = streamChunkSize*2 + 1
+		var buf bytes.Buffer
+		gz := gzip.NewWriter(&buf)
+		for i := 0; i < n; i++ {
+			fmt.Fprintf(gz, `{"original_url":"https://chunk.example.com/%d"}`+"\n", i)
+		}
+		gz.Close()
+
+		req := httptest.NewRequest(http.MethodPost, "/api/shorten/stream", &buf)
+		req.Header.Set("Content-Type", "application/x-ndjson")
+		req.Header.Set("Content-Encoding", "gzip")
+		w := httptest.NewRecorder()
+		middleware.DecompressRequest(middleware.BodyLimits{})(http.HandlerFunc(handler.StreamShortenURL)).ServeHTTP(w, req)
+
+		var progress []streamLine
+		for _, line := range readStream(t, w.Body) {
+			if line.Type == streamTypeProgress {
+				progress = append(progress, line)
+			}
+		}
+		if len(progress) != 3 || progress[0].Processed != streamChunkSize || progress[2].Created != n {
+			t.Errorf("Expected progress after each of 3 chunks, got %+v", progress)
+		}
+	})
+
+	t.Run("Oversized gzip", func(t *testing.T) {
+		// Сжатое тело мало, но распакованное превышает лимит до первого пакета
+		var buf bytes.Buffer
+		gz := gzip.NewWriter(&buf)
+		for i := 0; i < streamChunkSize/2; i++ {
+			fmt.Fprintf(gz, `{"original_url":"https://big.example.com/%d"}`+"\n", i)
+		}
+		gz.Close()
+		limits := middleware.BodyLimits{MaxSize: 4 << 10, MaxDecompressedSize: 4 << 10}
+		if buf.Len() > int(limits.MaxSize) {
+			t.Fatalf("Expected compressed body within the wire limit, got %d bytes", buf.Len())
+		}
+
+		req := httptest.NewRequest(http.MethodPost, "/api/shorten/stream", &buf)
+		req.Header.Set("Content-Type", "application/x-ndjson")
+		req.Header.Set("Content-Encoding", "gzip")
+		w := httptest.NewRecorder()
+		middleware.DecompressRequest(limits)(http.HandlerFunc(handler.StreamShortenURL)).ServeHTTP(w, req)
+		if w.Code != http.StatusRequestEntityTooLarge {
+			t.Errorf("Expected status %d, got %d", http.StatusRequestEntityTooLarge, w.Code)
+		}
+	})
+
+	t.Run("Wrong content type", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodPost, "/api/shorten/stream", strings.NewReader(`[]`))
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		handler.StreamShortenURL(w, req)
+		if w.Code != http.StatusUnsupportedMediaType {
+			t.Errorf("Expected status %d, got %d", http.StatusUnsupportedMediaType, w.Code)
+		}
+	})
+
+	t.Run("Storage unavailable", func(t *testing.T) {
+		service, err := newService(unavailableStorage{NewMemoryStorage()}, &config.Config{}, zap.NewNop())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer service.Close()
+
+		req := httptest.NewRequest(http.MethodPost, "/api/shorten/stream", strings.NewReader(`{"original_url":"https://ya.ru"}`))
+		req.Header.Set("Content-Type", "application/x-ndjson")
+		w := httptest.NewRecorder()
+		NewHandler(service).StreamShortenURL(w, req)
+		if w.Code != http.StatusServiceUnavailable {
+			t.Errorf("Expected status %d, got %d", http.StatusServiceUnavailable, w.Code)
+		}
+	})
+}
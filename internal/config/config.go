@@ -4,6 +4,32 @@ import (
 	"flag"
 	"fmt"
 	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// DefaultShortCodeLength — минимальная длина короткого кода по умолчанию.
+	DefaultShortCodeLength = 6
+	// MaxShortCodeLength — предел, до которого может вырасти длина кода.
+	MaxShortCodeLength = 32
+)
+
+// Хранилища ссылок. StorageBackendAuto выбирает первое доступное из
+// PostgreSQL, файла и памяти.
+const (
+	StorageBackendAuto     = "auto"
+	StorageBackendPostgres = "postgres"
+	StorageBackendFile     = "file"
+	StorageBackendMemory   = "memory"
+)
+
+// Стратегии генерации коротких кодов.
+const (
+	CodeStrategyRandom     = "random"
+	CodeStrategySequential = "sequential"
+	CodeStrategyHash       = "hash"
 )
 
 type Config struct {
@@ -11,6 +37,49 @@ type Config struct {
 	BaseURL         string
 	FileStoragePath string
 	DatabaseDSN     string
+	// StorageBackend — хранилище ссылок: postgres, file, memory или auto.
+	StorageBackend  string
+	ShortCodeLength int
+	CodeStrategy    string
+	// ExpiredSweepInterval — период удаления истёкших ссылок, 0 отключает очистку.
+	ExpiredSweepInterval time.Duration
+	// ExpiredRetention — сколько истёкшая ссылка хранится до удаления.
+	// Пока она хранится, её код отвечает 410, а не 404.
+	ExpiredRetention time.Duration
+	// AuthSecret — ключ подписи cookie с идентификатором пользователя.
+	AuthSecret string
+	// ShutdownTimeout — сколько ждать завершения активных запросов при остановке.
+	ShutdownTimeout time.Duration
+	// DrainDelay — сколько после сигнала остановки сервер продолжает
+	// обслуживать запросы с непройденной проверкой готовности, чтобы
+	// оркестратор успел снять с него трафик.
+	DrainDelay time.Duration
+	// Настройки пула соединений с базой данных.
+	DBMaxConns          int
+	DBMinConns          int
+	DBMaxConnLifetime   time.Duration
+	DBHealthCheckPeriod time.Duration
+	// AdminToken — токен доступа к административным эндпоинтам, пустое
+	// значение закрывает их.
+	AdminToken string
+	// MaxBodySize — предельный размер тела запроса в байтах в том виде,
+	// в каком оно передано, MaxDecompressedBodySize — после распаковки.
+	MaxBodySize             int64
+	MaxDecompressedBodySize int64
+	// StreamMaxBodySize — предельный размер тела потокового импорта
+	// до и после распаковки. Импорт не держит тело в памяти, поэтому
+	// лимит больше, чем у обычных запросов.
+	StreamMaxBodySize int64
+	// MaxBatchSize — предельное число элементов пакетного запроса.
+	MaxBatchSize int
+	// URLSchemes — схемы, которые разрешено сокращать.
+	URLSchemes []string
+	// MaxURLLength — предельная длина исходного URL после нормализации.
+	MaxURLLength int
+	// StripDefaultPort и StripFragment включают удаление порта по умолчанию
+	// для схемы и фрагмента при нормализации URL.
+	StripDefaultPort bool
+	StripFragment    bool
 }
 
 func NewConfig() (*Config, error) {
@@ -21,6 +90,27 @@ func NewConfig() (*Config, error) {
 	baseURL := flag.String("b", "http://localhost:8080", "base URL")
 	fileStoragePath := flag.String("f", "urls.json", "file storage path")
 	databaseDSN := flag.String("d", "", "database DSN")
+	storageBackend := flag.String("storage", StorageBackendAuto, "storage backend: postgres, file, memory or auto")
+	shortCodeLength := flag.Int("code-length", DefaultShortCodeLength, "minimal short code length")
+	codeStrategy := flag.String("code-strategy", CodeStrategyRandom, "short code strategy: random, sequential or hash")
+	expiredSweepInterval := flag.Duration("sweep-interval", time.Minute, "expired links sweep interval, 0 disables sweeping")
+	expiredRetention := flag.Duration("expired-retention", 30*24*time.Hour, "how long expired links are kept before sweeping")
+	authSecret := flag.String("auth-secret", "", "auth cookie signing key")
+	shutdownTimeout := flag.Duration("shutdown-timeout", 10*time.Second, "graceful shutdown timeout")
+	drainDelay := flag.Duration("drain-delay", 0, "delay before shutdown while readiness fails")
+	dbMaxConns := flag.Int("db-max-conns", 10, "maximum number of database connections")
+	dbMinConns := flag.Int("db-min-conns", 0, "minimum number of idle database connections")
+	dbMaxConnLifetime := flag.Duration("db-max-conn-lifetime", time.Hour, "maximum database connection lifetime")
+	dbHealthCheckPeriod := flag.Duration("db-health-check-period", time.Minute, "database connection health check period")
+	adminToken := flag.String("admin-token", "", "admin API bearer token")
+	maxBodySize := flag.Int64("max-body-size", 1<<20, "maximum request body size in bytes")
+	maxDecompressedBodySize := flag.Int64("max-decompressed-body-size", 8<<20, "maximum decompressed request body size in bytes")
+	streamMaxBodySize := flag.Int64("stream-max-body-size", 64<<20, "maximum streaming import body size in bytes, before and after decompression")
+	maxBatchSize := flag.Int("max-batch-size", 1000, "maximum number of items in a batch request")
+	urlSchemes := flag.String("url-schemes", "http,https", "comma-separated URL schemes allowed for shortening")
+	maxURLLength := flag.Int("max-url-length", 2048, "maximum URL length after normalization")
+	stripDefaultPort := flag.Bool("url-strip-default-port", true, "remove the scheme's default port from URLs")
+	stripFragment := flag.Bool("url-strip-fragment", false, "remove fragments from URLs")
 
 	flag.Parse()
 
@@ -37,11 +127,163 @@ func NewConfig() (*Config, error) {
 	if envDatabaseDSN := os.Getenv("DATABASE_DSN"); envDatabaseDSN != "" {
 		*databaseDSN = envDatabaseDSN
 	}
+	if envStorageBackend := os.Getenv("STORAGE_BACKEND"); envStorageBackend != "" {
+		*storageBackend = envStorageBackend
+	}
+	if envShortCodeLength := os.Getenv("SHORT_CODE_LENGTH"); envShortCodeLength != "" {
+		length, err := strconv.Atoi(envShortCodeLength)
+		if err != nil {
+			return nil, fmt.Errorf("invalid SHORT_CODE_LENGTH: %w", err)
+		}
+		*shortCodeLength = length
+	}
+	if envCodeStrategy := os.Getenv("SHORT_CODE_STRATEGY"); envCodeStrategy != "" {
+		*codeStrategy = envCodeStrategy
+	}
+	if envSweepInterval := os.Getenv("EXPIRED_SWEEP_INTERVAL"); envSweepInterval != "" {
+		interval, err := time.ParseDuration(envSweepInterval)
+		if err != nil {
+			return nil, fmt.Errorf("invalid EXPIRED_SWEEP_INTERVAL: %w", err)
+		}
+		*expiredSweepInterval = interval
+	}
+	if envRetention := os.Getenv("EXPIRED_RETENTION"); envRetention != "" {
+		retention, err := time.ParseDuration(envRetention)
+		if err != nil {
+			return nil, fmt.Errorf("invalid EXPIRED_RETENTION: %w", err)
+		}
+		*expiredRetention = retention
+	}
+	if envAuthSecret := os.Getenv("AUTH_SECRET"); envAuthSecret != "" {
+		*authSecret = envAuthSecret
+	}
+	if envShutdownTimeout := os.Getenv("SHUTDOWN_TIMEOUT"); envShutdownTimeout != "" {
+		timeout, err := time.ParseDuration(envShutdownTimeout)
+		if err != nil {
+			return nil, fmt.Errorf("invalid SHUTDOWN_TIMEOUT: %w", err)
+		}
+		*shutdownTimeout = timeout
+	}
+	if envDrainDelay := os.Getenv("DRAIN_DELAY"); envDrainDelay != "" {
+		delay, err := time.ParseDuration(envDrainDelay)
+		if err != nil {
+			return nil, fmt.Errorf("invalid DRAIN_DELAY: %w", err)
+		}
+		*drainDelay = delay
+	}
+	if envMaxBodySize := os.Getenv("MAX_BODY_SIZE"); envMaxBodySize != "" {
+		n, err := strconv.ParseInt(envMaxBodySize, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid MAX_BODY_SIZE: %w", err)
+		}
+		*maxBodySize = n
+	}
+	if envMaxDecompressedBodySize := os.Getenv("MAX_DECOMPRESSED_BODY_SIZE"); envMaxDecompressedBodySize != "" {
+		n, err := strconv.ParseInt(envMaxDecompressedBodySize, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid MAX_DECOMPRESSED_BODY_SIZE: %w", err)
+		}
+		*maxDecompressedBodySize = n
+	}
+	if envStreamMaxBodySize := os.Getenv("STREAM_MAX_BODY_SIZE"); envStreamMaxBodySize != "" {
+		n, err := strconv.ParseInt(envStreamMaxBodySize, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid STREAM_MAX_BODY_SIZE: %w", err)
+		}
+		*streamMaxBodySize = n
+	}
+	if envMaxBatchSize := os.Getenv("MAX_BATCH_SIZE"); envMaxBatchSize != "" {
+		n, err := strconv.Atoi(envMaxBatchSize)
+		if err != nil {
+			return nil, fmt.Errorf("invalid MAX_BATCH_SIZE: %w", err)
+		}
+		*maxBatchSize = n
+	}
+	if envURLSchemes := os.Getenv("URL_SCHEMES"); envURLSchemes != "" {
+		*urlSchemes = envURLSchemes
+	}
+	if envMaxURLLength := os.Getenv("MAX_URL_LENGTH"); envMaxURLLength != "" {
+		n, err := strconv.Atoi(envMaxURLLength)
+		if err != nil {
+			return nil, fmt.Errorf("invalid MAX_URL_LENGTH: %w", err)
+		}
+		*maxURLLength = n
+	}
+	if envStripDefaultPort := os.Getenv("URL_STRIP_DEFAULT_PORT"); envStripDefaultPort != "" {
+		v, err := strconv.ParseBool(envStripDefaultPort)
+		if err != nil {
+			return nil, fmt.Errorf("invalid URL_STRIP_DEFAULT_PORT: %w", err)
+		}
+		*stripDefaultPort = v
+	}
+	if envStripFragment := os.Getenv("URL_STRIP_FRAGMENT"); envStripFragment != "" {
+		v, err := strconv.ParseBool(envStripFragment)
+		if err != nil {
+			return nil, fmt.Errorf("invalid URL_STRIP_FRAGMENT: %w", err)
+		}
+		*stripFragment = v
+	}
+	if envDBMaxConns := os.Getenv("DB_MAX_CONNS"); envDBMaxConns != "" {
+		n, err := strconv.Atoi(envDBMaxConns)
+		if err != nil {
+			return nil, fmt.Errorf("invalid DB_MAX_CONNS: %w", err)
+		}
+		*dbMaxConns = n
+	}
+	if envDBMinConns := os.Getenv("DB_MIN_CONNS"); envDBMinConns != "" {
+		n, err := strconv.Atoi(envDBMinConns)
+		if err != nil {
+			return nil, fmt.Errorf("invalid DB_MIN_CONNS: %w", err)
+		}
+		*dbMinConns = n
+	}
+	if envDBMaxConnLifetime := os.Getenv("DB_MAX_CONN_LIFETIME"); envDBMaxConnLifetime != "" {
+		lifetime, err := time.ParseDuration(envDBMaxConnLifetime)
+		if err != nil {
+			return nil, fmt.Errorf("invalid DB_MAX_CONN_LIFETIME: %w", err)
+		}
+		*dbMaxConnLifetime = lifetime
+	}
+	if envDBHealthCheckPeriod := os.Getenv("DB_HEALTH_CHECK_PERIOD"); envDBHealthCheckPeriod != "" {
+		period, err := time.ParseDuration(envDBHealthCheckPeriod)
+		if err != nil {
+			return nil, fmt.Errorf("invalid DB_HEALTH_CHECK_PERIOD: %w", err)
+		}
+		*dbHealthCheckPeriod = period
+	}
+	if envAdminToken := os.Getenv("ADMIN_TOKEN"); envAdminToken != "" {
+		*adminToken = envAdminToken
+	}
 
 	cfg.ServerAddress = *serverAddress
 	cfg.BaseURL = *baseURL
 	cfg.FileStoragePath = *fileStoragePath
 	cfg.DatabaseDSN = *databaseDSN
+	cfg.StorageBackend = *storageBackend
+	cfg.ShortCodeLength = *shortCodeLength
+	cfg.CodeStrategy = *codeStrategy
+	cfg.ExpiredSweepInterval = *expiredSweepInterval
+	cfg.ExpiredRetention = *expiredRetention
+	cfg.AuthSecret = *authSecret
+	cfg.ShutdownTimeout = *shutdownTimeout
+	cfg.DrainDelay = *drainDelay
+	cfg.DBMaxConns = *dbMaxConns
+	cfg.DBMinConns = *dbMinConns
+	cfg.DBMaxConnLifetime = *dbMaxConnLifetime
+	cfg.DBHealthCheckPeriod = *dbHealthCheckPeriod
+	cfg.AdminToken = *adminToken
+	cfg.MaxBodySize = *maxBodySize
+	cfg.MaxDecompressedBodySize = *maxDecompressedBodySize
+	cfg.StreamMaxBodySize = *streamMaxBodySize
+	cfg.MaxBatchSize = *maxBatchSize
+	for _, scheme := range strings.Split(*urlSchemes, ",") {
+		if scheme = strings.ToLower(strings.TrimSpace(scheme)); scheme != "" {
+			cfg.URLSchemes = append(cfg.URLSchemes, scheme)
+		}
+	}
+	cfg.MaxURLLength = *maxURLLength
+	cfg.StripDefaultPort = *stripDefaultPort
+	cfg.StripFragment = *stripFragment
 
 	if err := cfg.validate(); err != nil {
 		return nil, fmt.Errorf("invalid config: %w", err)
@@ -57,5 +299,50 @@ func (cfg *Config) validate() error {
 	if cfg.BaseURL == "" {
 		return fmt.Errorf("base URL is required")
 	}
+	if cfg.ShortCodeLength < 1 || cfg.ShortCodeLength > MaxShortCodeLength {
+		return fmt.Errorf("short code length must be between 1 and %d", MaxShortCodeLength)
+	}
+	switch cfg.StorageBackend {
+	case StorageBackendAuto, StorageBackendMemory:
+	case StorageBackendPostgres:
+		if cfg.DatabaseDSN == "" {
+			return fmt.Errorf("database DSN is required for %s storage", cfg.StorageBackend)
+		}
+	case StorageBackendFile:
+		if cfg.FileStoragePath == "" {
+			return fmt.Errorf("file storage path is required for %s storage", cfg.StorageBackend)
+		}
+	default:
+		return fmt.Errorf("unknown storage backend %q", cfg.StorageBackend)
+	}
+	switch cfg.CodeStrategy {
+	case CodeStrategyRandom, CodeStrategySequential, CodeStrategyHash:
+	default:
+		return fmt.Errorf("unknown short code strategy %q", cfg.CodeStrategy)
+	}
+	if cfg.ExpiredRetention < 0 {
+		return fmt.Errorf("expired links retention must not be negative")
+	}
+	if cfg.DrainDelay < 0 {
+		return fmt.Errorf("drain delay must not be negative")
+	}
+	if cfg.MaxBodySize < 1 || cfg.MaxDecompressedBodySize < 1 || cfg.StreamMaxBodySize < 1 {
+		return fmt.Errorf("request body size limits must be positive")
+	}
+	if cfg.MaxBatchSize < 1 {
+		return fmt.Errorf("max batch size must be positive")
+	}
+	if len(cfg.URLSchemes) == 0 {
+		return fmt.Errorf("at least one URL scheme must be allowed")
+	}
+	if cfg.MaxURLLength < 1 {
+		return fmt.Errorf("max URL length must be positive")
+	}
+	if cfg.DBMaxConns < 1 {
+		return fmt.Errorf("database max connections must be positive")
+	}
+	if cfg.DBMinConns < 0 || cfg.DBMinConns > cfg.DBMaxConns {
+		return fmt.Errorf("database min connections must be between 0 and %d", cfg.DBMaxConns)
+	}
 	return nil
 }
@@ -0,0 +1,115 @@
+// Package export сериализует ссылки для выгрузки в CSV и NDJSON.
+package export
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"time"
+
+	"github.com/vvityuk/shortener/internal/storage"
+)
+
+// Форматы выгрузки.
+const (
+	FormatCSV    = "csv"
+	FormatNDJSON = "ndjson"
+)
+
+// Columns — колонки CSV и поля записи NDJSON в порядке вывода.
+var Columns = []string{"short_url", "original_url", "user_id", "created_at", "expires_at", "is_deleted"}
+
+// Writer пишет ссылки в выбранном формате. Записи буферизуются, поэтому
+// после последней нужно вызвать Flush.
+type Writer interface {
+	Write(u storage.URL) error
+	Flush() error
+}
+
+// NewWriter возвращает Writer для формата format.
+func NewWriter(w io.Writer, format string) (Writer, error) {
+	switch format {
+	case FormatCSV:
+		cw := csv.NewWriter(w)
+		if err := cw.Write(Columns); err != nil {
+			return nil, err
+		}
+		return &csvWriter{w: cw}, nil
+	case FormatNDJSON:
+		bw := bufio.NewWriter(w)
+		return &ndjsonWriter{w: bw, enc: json.NewEncoder(bw)}, nil
+	default:
+		return nil, fmt.Errorf("unknown export format %q", format)
+	}
+}
+
+// ContentType возвращает MIME-тип формата.
+func ContentType(format string) string {
+	if format == FormatCSV {
+		return "text/csv; charset=utf-8"
+	}
+	return "application/x-ndjson"
+}
+
+type csvWriter struct {
+	w *csv.Writer
+}
+
+func (c *csvWriter) Write(u storage.URL) error {
+	return c.w.Write([]string{
+		u.ShortURL, u.OriginalURL, u.UserID,
+		formatTime(u.CreatedAt), formatTime(u.ExpiresAt), strconv.FormatBool(u.Deleted),
+	})
+}
+
+func (c *csvWriter) Flush() error {
+	c.w.Flush()
+	return c.w.Error()
+}
+
+// record — запись NDJSON. Пустые user_id, created_at (у ссылок, созданных
+// до появления поля) и expires_at опускаются.
+type record struct {
+	ShortURL    string     `json:"short_url"`
+	OriginalURL string     `json:"original_url"`
+	UserID      string     `json:"user_id,omitempty"`
+	CreatedAt   *time.Time `json:"created_at,omitempty"`
+	ExpiresAt   *time.Time `json:"expires_at,omitempty"`
+	Deleted     bool       `json:"is_deleted"`
+}
+
+type ndjsonWriter struct {
+	w   *bufio.Writer
+	enc *json.Encoder
+}
+
+func (n *ndjsonWriter) Write(u storage.URL) error {
+	rec := record{ShortURL: u.ShortURL, OriginalURL: u.OriginalURL, UserID: u.UserID, Deleted: u.Deleted}
+	rec.CreatedAt = utc(u.CreatedAt)
+	rec.ExpiresAt = utc(u.ExpiresAt)
+	return n.enc.Encode(rec)
+}
+
+// utc возвращает момент в UTC или nil для нулевого.
+func utc(t time.Time) *time.Time {
+	if t.IsZero() {
+		return nil
+	}
+	t = t.UTC()
+	return &t
+}
+
+func (n *ndjsonWriter) Flush() error {
+	return n.w.Flush()
+}
+
+// formatTime форматирует момент в RFC 3339 (UTC), нулевой — пустой строкой.
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.UTC().Format(time.RFC3339Nano)
+}
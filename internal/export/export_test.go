@@ -0,0 +1,52 @@
+package export
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/vvityuk/shortener/internal/storage"
+)
+
+func TestWriter(t *testing.T) {
+	createdAt := time.Date(2024, 5, 1, 12, 0, 0, 0, time.FixedZone("MSK", 3*60*60))
+	urls := []storage.URL{
+		{ShortURL: "abc", OriginalURL: "https://example.com/?a=1,2", UserID: "alice", CreatedAt: createdAt},
+		{ShortURL: "def", OriginalURL: "https://ya.ru", CreatedAt: createdAt, ExpiresAt: createdAt.Add(time.Hour), Deleted: true},
+	}
+
+	tests := []struct {
+		format   string
+		expected string
+	}{
+		{FormatCSV, "short_url,original_url,user_id,created_at,expires_at,is_deleted\n" +
+			"abc,\"https://example.com/?a=1,2\",alice,2024-05-01T09:00:00Z,,false\n" +
+			"def,https://ya.ru,,2024-05-01T09:00:00Z,2024-05-01T10:00:00Z,true\n"},
+		{FormatNDJSON, `{"short_url":"abc","original_url":"https://example.com/?a=1,2","user_id":"alice","created_at":"2024-05-01T09:00:00Z","is_deleted":false}` + "\n" +
+			`{"short_url":"def","original_url":"https://ya.ru","created_at":"2024-05-01T09:00:00Z","expires_at":"2024-05-01T10:00:00Z","is_deleted":true}` + "\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.format, func(t *testing.T) {
+			var buf bytes.Buffer
+			w, err := NewWriter(&buf, tt.format)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, u := range urls {
+				if err := w.Write(u); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := w.Flush(); err != nil {
+				t.Fatal(err)
+			}
+			if buf.String() != tt.expected {
+				t.Errorf("Expected\n%s\ngot\n%s", tt.expected, buf.String())
+			}
+		})
+	}
+
+	if _, err := NewWriter(&bytes.Buffer{}, "xml"); err == nil {
+		t.Error("Expected an error for unknown format")
+	}
+}
@@ -0,0 +1,60 @@
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestCheckerServeHTTP(t *testing.T) {
+	c := NewChecker(50 * time.Millisecond)
+	c.Add("ok", func(context.Context) error { return nil })
+	c.Add("broken", func(context.Context) error { return errors.New("disk is full") })
+	// Проверка, не уважающая контекст, не должна задерживать ответ
+	c.Add("hanging", func(context.Context) error {
+		time.Sleep(time.Second)
+		return nil
+	})
+
+	w := httptest.NewRecorder()
+	start := time.Now()
+	c.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Errorf("Expected checks to be cut off by timeout, took %v", elapsed)
+	}
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected status %d, got %d", http.StatusServiceUnavailable, w.Code)
+	}
+
+	var report Report
+	if err := json.NewDecoder(w.Body).Decode(&report); err != nil {
+		t.Fatal(err)
+	}
+	expected := []CheckResult{
+		{Name: "ok", Status: StatusOK},
+		{Name: "broken", Status: StatusFail, Error: "disk is full"},
+		{Name: "hanging", Status: StatusFail, Error: context.DeadlineExceeded.Error()},
+	}
+	if report.Status != StatusFail || len(report.Checks) != len(expected) {
+		t.Fatalf("Unexpected report %+v", report)
+	}
+	for i, e := range expected {
+		got := report.Checks[i]
+		got.LatencyMS = 0
+		if got != e {
+			t.Errorf("Expected check %+v, got %+v", e, got)
+		}
+	}
+}
+
+func TestLive(t *testing.T) {
+	w := httptest.NewRecorder()
+	Live(w, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+	if w.Code != http.StatusOK || w.Body.String() != "{\"status\":\"ok\",\"checks\":[]}\n" {
+		t.Errorf("Unexpected response %d %q", w.Code, w.Body.String())
+	}
+}
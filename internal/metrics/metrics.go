@@ -0,0 +1,328 @@
+// Package metrics реализует минимальный набор метрик Prometheus — счётчики,
+// гистограммы и вычисляемые при сборе датчики — и их вывод в текстовом
+// формате экспозиции версии 0.0.4.
+package metrics
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// DefBuckets — границы гистограмм длительности в секундах по умолчанию.
+var DefBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// metric — семейство метрик с общим именем.
+type metric interface {
+	name() string
+	write(ctx context.Context, w *bufio.Writer)
+}
+
+// Registry хранит зарегистрированные метрики и выводит их. Имена метрик
+// должны быть уникальны: повторная регистрация — ошибка программиста
+// и вызывает панику.
+type Registry struct {
+	mu      sync.Mutex
+	metrics map[string]metric
+}
+
+func NewRegistry() *Registry {
+	return &Registry{metrics: make(map[string]metric)}
+}
+
+func (r *Registry) register(m metric) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.metrics[m.name()]; ok {
+		panic(fmt.Sprintf("metrics: %s is already registered", m.name()))
+	}
+	r.metrics[m.name()] = m
+}
+
+// Write выводит все метрики в текстовом формате, упорядочив их по имени,
+// а ряды внутри метрики — по значениям меток.
+func (r *Registry) Write(ctx context.Context, w io.Writer) error {
+	r.mu.Lock()
+	metrics := make([]metric, 0, len(r.metrics))
+	for _, m := range r.metrics {
+		metrics = append(metrics, m)
+	}
+	r.mu.Unlock()
+	sort.Slice(metrics, func(i, j int) bool { return metrics[i].name() < metrics[j].name() })
+
+	bw := bufio.NewWriter(w)
+	for _, m := range metrics {
+		m.write(ctx, bw)
+	}
+	return bw.Flush()
+}
+
+// ServeHTTP отдаёт метрики по запросу Prometheus.
+func (r *Registry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	r.Write(req.Context(), w)
+}
+
+// desc — общая часть семейства: имя, описание и имена меток.
+type desc struct {
+	metricName string
+	help       string
+	labels     []string
+}
+
+func (d *desc) name() string {
+	return d.metricName
+}
+
+func (d *desc) writeHeader(w *bufio.Writer, typ string) {
+	fmt.Fprintf(w, "# HELP %s %s\n", d.metricName, escapeHelp(d.help))
+	fmt.Fprintf(w, "# TYPE %s %s\n", d.metricName, typ)
+}
+
+// vec — ряды семейства, индексированные значениями меток.
+type vec[T any] struct {
+	desc
+	mu     sync.RWMutex
+	series map[string]*labeled[T]
+	create func() *T
+}
+
+type labeled[T any] struct {
+	values []string
+	value  *T
+}
+
+func (v *vec[T]) with(values []string) *T {
+	if len(values) != len(v.labels) {
+		panic(fmt.Sprintf("metrics: %s expects %d label values, got %d", v.metricName, len(v.labels), len(values)))
+	}
+	key := strings.Join(values, "\xff")
+	v.mu.RLock()
+	s, ok := v.series[key]
+	v.mu.RUnlock()
+	if ok {
+		return s.value
+	}
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if s, ok := v.series[key]; ok {
+		return s.value
+	}
+	s = &labeled[T]{values: append([]string(nil), values...), value: v.create()}
+	v.series[key] = s
+	return s.value
+}
+
+// sorted возвращает ряды в порядке значений меток.
+func (v *vec[T]) sorted() []*labeled[T] {
+	v.mu.RLock()
+	series := make([]*labeled[T], 0, len(v.series))
+	for _, s := range v.series {
+		series = append(series, s)
+	}
+	v.mu.RUnlock()
+	sort.Slice(series, func(i, j int) bool {
+		a, b := series[i].values, series[j].values
+		for k := range a {
+			if a[k] != b[k] {
+				return a[k] < b[k]
+			}
+		}
+		return false
+	})
+	return series
+}
+
+// Counter — монотонно растущий счётчик.
+type Counter struct {
+	v atomic.Uint64
+}
+
+func (c *Counter) Inc() {
+	c.v.Add(1)
+}
+
+func (c *Counter) Add(n uint64) {
+	c.v.Add(n)
+}
+
+// Value возвращает текущее значение счётчика.
+func (c *Counter) Value() uint64 {
+	return c.v.Load()
+}
+
+// CounterVec — семейство счётчиков с метками.
+type CounterVec struct {
+	vec[Counter]
+}
+
+// NewCounterVec регистрирует семейство счётчиков с метками labels.
+func (r *Registry) NewCounterVec(name, help string, labels ...string) *CounterVec {
+	c := &CounterVec{vec[Counter]{
+		desc:   desc{metricName: name, help: help, labels: labels},
+		series: make(map[string]*labeled[Counter]),
+		create: func() *Counter { return &Counter{} },
+	}}
+	r.register(c)
+	return c
+}
+
+// NewCounter регистрирует счётчик без меток.
+func (r *Registry) NewCounter(name, help string) *Counter {
+	return r.NewCounterVec(name, help).WithLabelValues()
+}
+
+// WithLabelValues возвращает счётчик ряда с указанными значениями меток,
+// создавая его при первом обращении.
+func (c *CounterVec) WithLabelValues(values ...string) *Counter {
+	return c.with(values)
+}
+
+func (c *CounterVec) write(_ context.Context, w *bufio.Writer) {
+	c.writeHeader(w, "counter")
+	for _, s := range c.sorted() {
+		writeSample(w, c.metricName, c.labels, s.values, "", "", strconv.FormatUint(s.value.Value(), 10))
+	}
+}
+
+// Histogram распределяет наблюдения по корзинам с верхними границами.
+type Histogram struct {
+	bounds []float64
+	counts []atomic.Uint64 // counts[i] — наблюдения не больше bounds[i], последняя — +Inf
+	sum    atomic.Uint64   // биты float64
+	count  atomic.Uint64
+}
+
+func (h *Histogram) Observe(v float64) {
+	i := sort.SearchFloat64s(h.bounds, v)
+	h.counts[i].Add(1)
+	h.count.Add(1)
+	for {
+		old := h.sum.Load()
+		if h.sum.CompareAndSwap(old, math.Float64bits(math.Float64frombits(old)+v)) {
+			return
+		}
+	}
+}
+
+// HistogramVec — семейство гистограмм с метками.
+type HistogramVec struct {
+	vec[Histogram]
+	bounds []float64
+}
+
+// NewHistogramVec регистрирует семейство гистограмм с границами корзин
+// buckets (по возрастанию) и метками labels.
+func (r *Registry) NewHistogramVec(name, help string, buckets []float64, labels ...string) *HistogramVec {
+	bounds := append([]float64(nil), buckets...)
+	h := &HistogramVec{vec: vec[Histogram]{
+		desc:   desc{metricName: name, help: help, labels: labels},
+		series: make(map[string]*labeled[Histogram]),
+		create: func() *Histogram {
+			return &Histogram{bounds: bounds, counts: make([]atomic.Uint64, len(bounds)+1)}
+		},
+	}, bounds: bounds}
+	r.register(h)
+	return h
+}
+
+// WithLabelValues возвращает гистограмму ряда с указанными значениями меток.
+func (h *HistogramVec) WithLabelValues(values ...string) *Histogram {
+	return h.with(values)
+}
+
+func (h *HistogramVec) write(_ context.Context, w *bufio.Writer) {
+	h.writeHeader(w, "histogram")
+	for _, s := range h.sorted() {
+		var cumulative uint64
+		for i := range s.value.counts {
+			cumulative += s.value.counts[i].Load()
+			le := "+Inf"
+			if i < len(h.bounds) {
+				le = formatFloat(h.bounds[i])
+			}
+			writeSample(w, h.metricName+"_bucket", h.labels, s.values, "le", le, strconv.FormatUint(cumulative, 10))
+		}
+		sum := math.Float64frombits(s.value.sum.Load())
+		writeSample(w, h.metricName+"_sum", h.labels, s.values, "", "", formatFloat(sum))
+		writeSample(w, h.metricName+"_count", h.labels, s.values, "", "", strconv.FormatUint(s.value.count.Load(), 10))
+	}
+}
+
+// gaugeFunc — датчик, значение которого вычисляется при каждом сборе.
+type gaugeFunc struct {
+	desc
+	fn func(ctx context.Context) (float64, error)
+}
+
+// NewGaugeFunc регистрирует датчик, значение которого вычисляет fn при
+// каждом сборе метрик. Если fn вернула ошибку, значение не выводится.
+func (r *Registry) NewGaugeFunc(name, help string, fn func(ctx context.Context) (float64, error)) {
+	r.register(&gaugeFunc{desc: desc{metricName: name, help: help}, fn: fn})
+}
+
+func (g *gaugeFunc) write(ctx context.Context, w *bufio.Writer) {
+	g.writeHeader(w, "gauge")
+	if v, err := g.fn(ctx); err == nil {
+		writeSample(w, g.metricName, nil, nil, "", "", formatFloat(v))
+	}
+}
+
+// writeSample выводит строку ряда. extraName и extraValue — дополнительная
+// метка, например le у корзин гистограммы.
+func writeSample(w *bufio.Writer, name string, labels, values []string, extraName, extraValue, value string) {
+	w.WriteString(name)
+	if len(labels) > 0 || extraName != "" {
+		w.WriteByte('{')
+		for i, label := range labels {
+			if i > 0 {
+				w.WriteByte(',')
+			}
+			fmt.Fprintf(w, `%s="%s"`, label, escapeLabel(values[i]))
+		}
+		if extraName != "" {
+			if len(labels) > 0 {
+				w.WriteByte(',')
+			}
+			fmt.Fprintf(w, `%s="%s"`, extraName, extraValue)
+		}
+		w.WriteByte('}')
+	}
+	w.WriteByte(' ')
+	w.WriteString(value)
+	w.WriteByte('\n')
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+var (
+	helpEscaper  = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+	labelEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+)
+
+func escapeHelp(s string) string {
+	return helpEscaper.Replace(s)
+}
+
+func escapeLabel(s string) string {
+	return labelEscaper.Replace(s)
+}
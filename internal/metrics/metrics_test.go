@@ -0,0 +1,82 @@
+package metrics
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/vvityuk/shortener/internal/golden"
+)
+
+func TestRegistryWrite(t *testing.T) {
+	reg := NewRegistry()
+
+	requests := reg.NewCounterVec("http_requests_total", "Total HTTP requests.", "method", "route")
+	requests.WithLabelValues("POST", "/").Add(2)
+	requests.WithLabelValues("GET", "/{shortCode}").Inc()
+	requests.WithLabelValues("GET", `/with "quotes" and \ slash`).Inc()
+
+	reg.NewCounter("redirects_total", "Total redirects.\nSecond line.").Add(5)
+
+	latency := reg.NewHistogramVec("request_duration_seconds", "Request latency.", []float64{0.1, 0.5, 1}, "method")
+	for _, v := range []float64{0.05, 0.1, 0.3, 2} {
+		latency.WithLabelValues("GET").Observe(v)
+	}
+	latency.WithLabelValues("POST").Observe(0.5)
+
+	reg.NewGaugeFunc("links", "Stored links.", func(context.Context) (float64, error) { return 42, nil })
+	reg.NewGaugeFunc("broken", "Gauge that fails.", func(context.Context) (float64, error) { return 0, errors.New("unavailable") })
+
+	var buf bytes.Buffer
+	if err := reg.Write(context.Background(), &buf); err != nil {
+		t.Fatal(err)
+	}
+	golden.Check(t, "registry", buf.Bytes())
+
+	w := httptest.NewRecorder()
+	reg.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if ct := w.Header().Get("Content-Type"); ct != "text/plain; version=0.0.4; charset=utf-8" {
+		t.Errorf("Unexpected Content-Type %q", ct)
+	}
+	if !bytes.Equal(w.Body.Bytes(), buf.Bytes()) {
+		t.Error("Expected handler to serve the same output")
+	}
+}
+
+func TestRegistryConcurrency(t *testing.T) {
+	reg := NewRegistry()
+	counter := reg.NewCounterVec("c_total", "Counter.", "label")
+	histogram := reg.NewHistogramVec("h_seconds", "Histogram.", DefBuckets, "label")
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 1000; j++ {
+				counter.WithLabelValues("a").Inc()
+				histogram.WithLabelValues("a").Observe(0.25)
+			}
+		}()
+	}
+	wg.Wait()
+
+	var buf bytes.Buffer
+	reg.Write(context.Background(), &buf)
+	golden.Check(t, "concurrency", buf.Bytes())
+}
+
+func TestRegisterTwice(t *testing.T) {
+	reg := NewRegistry()
+	reg.NewCounter("dup_total", "Counter.")
+	defer func() {
+		if recover() == nil {
+			t.Error("Expected panic on duplicate registration")
+		}
+	}()
+	reg.NewCounter("dup_total", "Counter.")
+}
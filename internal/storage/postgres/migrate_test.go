@@ -0,0 +1,49 @@
+package postgres
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLoadMigrations(t *testing.T) {
+	migrations, err := loadMigrations()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(migrations) == 0 {
+		t.Fatal("Expected embedded migrations")
+	}
+
+	for i, m := range migrations {
+		if m.version != i+1 {
+			t.Errorf("Expected migration %d to have version %d, got %d", i, i+1, m.version)
+		}
+		if m.up == "" || m.down == "" {
+			t.Errorf("Expected migration %04d_%s to have up and down scripts", m.version, m.name)
+		}
+	}
+}
+
+func TestCheckApplied(t *testing.T) {
+	migrations, err := loadMigrations()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	applied := make(map[int]time.Time)
+	for _, m := range migrations {
+		applied[m.version] = time.Now()
+	}
+	if err := checkApplied(applied, migrations); err != nil {
+		t.Errorf("Expected up-to-date schema to pass, got %v", err)
+	}
+
+	last := migrations[len(migrations)-1]
+	delete(applied, last.version)
+	err = checkApplied(applied, migrations)
+	if err == nil || !strings.Contains(err.Error(), fmt.Sprintf("%04d_%s", last.version, last.name)) {
+		t.Errorf("Expected missing migration %04d to be reported, got %v", last.version, err)
+	}
+}
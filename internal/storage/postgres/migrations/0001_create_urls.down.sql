@@ -0,0 +1,2 @@
+DROP SEQUENCE IF EXISTS short_code_seq;
+DROP TABLE IF EXISTS urls;
@@ -0,0 +1,9 @@
+CREATE TABLE IF NOT EXISTS urls (
+	id SERIAL PRIMARY KEY,
+	short_url VARCHAR(255) UNIQUE NOT NULL,
+	original_url TEXT NOT NULL,
+	created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+	UNIQUE(original_url)
+);
+
+CREATE SEQUENCE IF NOT EXISTS short_code_seq;
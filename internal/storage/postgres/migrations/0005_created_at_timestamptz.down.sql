@@ -0,0 +1,2 @@
+ALTER TABLE urls ALTER COLUMN created_at DROP NOT NULL;
+ALTER TABLE urls ALTER COLUMN created_at TYPE TIMESTAMP;
@@ -0,0 +1,3 @@
+UPDATE urls SET created_at = CURRENT_TIMESTAMP WHERE created_at IS NULL;
+ALTER TABLE urls ALTER COLUMN created_at TYPE TIMESTAMPTZ;
+ALTER TABLE urls ALTER COLUMN created_at SET NOT NULL;
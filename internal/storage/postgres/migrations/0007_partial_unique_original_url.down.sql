@@ -0,0 +1,5 @@
+DELETE FROM urls a USING urls b
+WHERE a.original_url = b.original_url AND a.id <> b.id AND a.is_deleted
+	AND (NOT b.is_deleted OR b.id > a.id);
+DROP INDEX IF EXISTS urls_original_url_live_key;
+ALTER TABLE urls ADD CONSTRAINT urls_original_url_key UNIQUE (original_url);
@@ -2,123 +2,490 @@ package postgres
 
 import (
 	"context"
-	"database/sql"
+	"errors"
 	"fmt"
+	"io"
+	"net"
+	"time"
 
-	_ "github.com/jackc/pgx/v5/stdlib"
+	"github.com/jackc/pgerrcode"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/vvityuk/shortener/internal/storage"
 )
 
+// shortURLConstraint — имя ограничения уникальности короткого кода.
+const shortURLConstraint = "urls_short_url_key"
+
+// cursorFetchSize — сколько строк ForEach читает из курсора за раз.
+const cursorFetchSize = 1000
+
+// PoolOptions — настройки пула соединений. Нулевые значения оставляют
+// значения pgxpool по умолчанию.
+type PoolOptions struct {
+	MaxConns          int32
+	MinConns          int32
+	MaxConnLifetime   time.Duration
+	HealthCheckPeriod time.Duration
+}
+
 type Storage struct {
-	db *sql.DB
+	pool *pgxpool.Pool
+}
+
+func New(dsn string, opts PoolOptions) (*Storage, error) {
+	pool, err := Open(dsn, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := MigrateUp(context.Background(), pool); err != nil {
+		pool.Close()
+		return nil, fmt.Errorf("failed to migrate database: %w", err)
+	}
+
+	return &Storage{pool: pool}, nil
 }
 
-func New(dsn string) (*Storage, error) {
-	db, err := sql.Open("pgx", dsn)
+// NewReadOnly подключается к базе только для чтения: миграции не
+// применяются, а все транзакции соединений пула read-only. Если в базе
+// применены не все миграции сервиса, возвращается ошибка.
+func NewReadOnly(dsn string, opts PoolOptions) (*Storage, error) {
+	pool, err := open(dsn, opts, true)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := CheckSchema(context.Background(), pool); err != nil {
+		pool.Close()
+		return nil, err
+	}
+
+	return &Storage{pool: pool}, nil
+}
+
+// Open создаёт пул соединений без применения миграций.
+func Open(dsn string, opts PoolOptions) (*pgxpool.Pool, error) {
+	return open(dsn, opts, false)
+}
+
+func open(dsn string, opts PoolOptions, readOnly bool) (*pgxpool.Pool, error) {
+	poolConfig, err := pgxpool.ParseConfig(dsn)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse database DSN: %w", err)
+	}
+	if readOnly {
+		// Запись отклоняет сам сервер, даже если до неё дойдёт код
+		poolConfig.ConnConfig.RuntimeParams["default_transaction_read_only"] = "on"
+	}
+	if opts.MaxConns > 0 {
+		poolConfig.MaxConns = opts.MaxConns
+	}
+	if opts.MinConns > 0 {
+		poolConfig.MinConns = opts.MinConns
+	}
+	if opts.MaxConnLifetime > 0 {
+		poolConfig.MaxConnLifetime = opts.MaxConnLifetime
+	}
+	if opts.HealthCheckPeriod > 0 {
+		poolConfig.HealthCheckPeriod = opts.HealthCheckPeriod
+	}
+
+	ctx := context.Background()
+	pool, err := pgxpool.NewWithConfig(ctx, poolConfig)
 	if err != nil {
 		return nil, fmt.Errorf("failed to connect to database: %w", err)
 	}
 
-	if err := db.Ping(); err != nil {
+	if err := pool.Ping(ctx); err != nil {
+		pool.Close()
 		return nil, fmt.Errorf("failed to ping database: %w", err)
 	}
+	return pool, nil
+}
 
-	if err := createTables(db); err != nil {
-		return nil, fmt.Errorf("failed to create tables: %w", err)
+func (s *Storage) Get(ctx context.Context, key string) (storage.URL, error) {
+	u := storage.URL{ShortURL: key}
+	var userID *string
+	var expiresAt *time.Time
+	err := s.pool.QueryRow(ctx,
+		"SELECT original_url, user_id, expires_at, is_deleted, created_at FROM urls WHERE short_url = $1", key).
+		Scan(&u.OriginalURL, &userID, &expiresAt, &u.Deleted, &u.CreatedAt)
+	if err != nil {
+		return storage.URL{}, mapError(err)
 	}
-
-	return &Storage{db: db}, nil
+	if userID != nil {
+		u.UserID = *userID
+	}
+	if expiresAt != nil {
+		u.ExpiresAt = *expiresAt
+	}
+	return u, nil
 }
 
-func createTables(db *sql.DB) error {
-	query := `
-		CREATE TABLE IF NOT EXISTS urls (
-			id SERIAL PRIMARY KEY,
-			short_url VARCHAR(255) UNIQUE NOT NULL,
-			original_url TEXT NOT NULL,
-			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
-			UNIQUE(original_url)
-		);
-	`
-	_, err := db.Exec(query)
-	return err
+// GetUserURLs возвращает действующие ссылки пользователя userID.
+func (s *Storage) GetUserURLs(ctx context.Context, userID string) ([]storage.URL, error) {
+	rows, err := s.pool.Query(ctx, `
+		SELECT short_url, original_url, expires_at, created_at FROM urls
+		WHERE user_id = $1 AND NOT is_deleted AND (expires_at IS NULL OR expires_at > now())
+		ORDER BY id
+	`, userID)
+	if err != nil {
+		return nil, mapError(err)
+	}
+	defer rows.Close()
+
+	var urls []storage.URL
+	for rows.Next() {
+		u := storage.URL{UserID: userID}
+		var expiresAt *time.Time
+		if err := rows.Scan(&u.ShortURL, &u.OriginalURL, &expiresAt, &u.CreatedAt); err != nil {
+			return nil, mapError(err)
+		}
+		if expiresAt != nil {
+			u.ExpiresAt = *expiresAt
+		}
+		urls = append(urls, u)
+	}
+	return urls, mapError(rows.Err())
 }
 
-func (s *Storage) Get(key string) (string, bool) {
-	var originalURL string
-	err := s.db.QueryRow("SELECT original_url FROM urls WHERE short_url = $1", key).Scan(&originalURL)
-	if err == sql.ErrNoRows {
-		return "", false
+// retireQuery помечает удалёнными истёкшие ссылки на исходные URL, чтобы
+// они не занимали уникальный индекс действующих ссылок. Сама ссылка
+// остаётся в таблице, и её код по-прежнему отвечает 410.
+const retireQuery = `
+	UPDATE urls SET is_deleted = TRUE
+	WHERE original_url = ANY($1) AND NOT is_deleted AND expires_at IS NOT NULL AND expires_at <= now()
+`
+
+// upsertQuery вставляет ссылку, если у исходного URL нет действующей ссылки,
+// и возвращает код ссылки на URL и признак того, что она создана сейчас.
+// Удалённые ссылки не участвуют в уникальном индексе по original_url, поэтому
+// новая ссылка добавляется отдельной строкой, а старая сохраняет свой код.
+const upsertQuery = `
+	WITH inserted AS (
+		INSERT INTO urls (short_url, original_url, user_id, expires_at, created_at, is_deleted)
+		VALUES ($1, $2, $3, $4, COALESCE($5, CURRENT_TIMESTAMP), $6)
+		ON CONFLICT (original_url) WHERE NOT is_deleted DO NOTHING
+		RETURNING short_url
+	)
+	SELECT short_url, true as is_new
+	FROM inserted
+	UNION ALL
+	SELECT short_url, false as is_new
+	FROM urls
+	WHERE original_url = $2 AND NOT is_deleted
+	LIMIT 1
+`
+
+// Save сохраняет ссылку. Если URL уже сокращён и ссылка ещё действует,
+// возвращается существующий код и *storage.ConflictError; после истёкшей
+// или удалённой ссылки добавляется новая.
+func (s *Storage) Save(ctx context.Context, u storage.URL) (string, error) {
+	results, err := s.BatchSave(ctx, []storage.URL{u})
+	if err != nil {
+		return "", err
+	}
+	if results[0].Existing {
+		return results[0].ShortURL, &storage.ConflictError{ShortURL: results[0].ShortURL}
 	}
+	return results[0].ShortURL, nil
+}
+
+// BatchSave сохраняет ссылки одним пакетом запросов в транзакции:
+// все строки уходят на сервер за один сетевой обмен. Сначала истёкшие
+// ссылки на те же URL помечаются удалёнными, затем каждая строка
+// вставляется отдельным запросом, поэтому уже сокращённые URL и повторы
+// внутри пакета получают существующий код.
+func (s *Storage) BatchSave(ctx context.Context, items []storage.URL) ([]storage.SaveResult, error) {
+	tx, err := s.pool.Begin(ctx)
 	if err != nil {
-		return "", false
+		return nil, mapError(err)
+	}
+	defer tx.Rollback(ctx)
+
+	originals := make([]string, 0, len(items))
+	for _, u := range items {
+		originals = append(originals, u.OriginalURL)
+	}
+	batch := &pgx.Batch{}
+	batch.Queue(retireQuery, originals)
+	for _, u := range items {
+		batch.Queue(upsertQuery, u.ShortURL, u.OriginalURL, nullString(u.UserID), nullTime(u.ExpiresAt), nullTime(u.CreatedAt), u.Deleted)
+	}
+	br := tx.SendBatch(ctx, batch)
+	if _, err := br.Exec(); err != nil {
+		br.Close()
+		return nil, mapError(err)
+	}
+	results := make([]storage.SaveResult, len(items))
+	for i := range items {
+		var isNew bool
+		if err := br.QueryRow().Scan(&results[i].ShortURL, &isNew); err != nil {
+			br.Close()
+			return nil, mapError(err)
+		}
+		results[i].Existing = !isNew
+	}
+	if err := br.Close(); err != nil {
+		return nil, mapError(err)
 	}
-	return originalURL, true
+
+	if err := tx.Commit(ctx); err != nil {
+		return nil, mapError(err)
+	}
+	return results, nil
 }
 
-func (s *Storage) Save(key, value string) (string, bool, error) {
-	var shortURL string
-	var isNew bool
-	query := `
-		WITH upsert AS (
-			INSERT INTO urls (short_url, original_url)
-			VALUES ($1, $2)
-			ON CONFLICT (original_url) DO NOTHING
-			RETURNING short_url, true as is_new
+// DeleteURLs помечает удалёнными ссылки пользователей одним многострочным UPDATE.
+func (s *Storage) DeleteURLs(ctx context.Context, items []storage.DeleteRequest) error {
+	if len(items) == 0 {
+		return nil
+	}
+	codes := make([]string, 0, len(items))
+	users := make([]string, 0, len(items))
+	for _, item := range items {
+		codes = append(codes, item.ShortURL)
+		users = append(users, item.UserID)
+	}
+	_, err := s.pool.Exec(ctx, `
+		UPDATE urls SET is_deleted = TRUE
+		FROM unnest($1::text[], $2::text[]) AS d(short_url, user_id)
+		WHERE urls.short_url = d.short_url AND urls.user_id = d.user_id AND NOT urls.is_deleted
+	`, codes, users)
+	return mapError(err)
+}
+
+// DeleteExpired удаляет ссылки, срок действия которых истёк к now.
+func (s *Storage) DeleteExpired(ctx context.Context, now time.Time) (int, error) {
+	// Вместе со ссылками удаляются их переходы
+	var n int
+	err := s.pool.QueryRow(ctx, `
+		WITH purged AS (
+			DELETE FROM urls WHERE expires_at <= $1 RETURNING short_url
+		), dropped AS (
+			DELETE FROM clicks WHERE short_url IN (SELECT short_url FROM purged)
 		)
-		SELECT short_url, COALESCE(is_new, false) as is_new 
-		FROM upsert
-		UNION ALL
-		SELECT short_url, false as is_new 
-		FROM urls 
-		WHERE original_url = $2
-		LIMIT 1
-	`
-	err := s.db.QueryRow(query, key, value).Scan(&shortURL, &isNew)
+		SELECT count(*) FROM purged
+	`, now).Scan(&n)
+	if err != nil {
+		return 0, mapError(err)
+	}
+	return n, nil
+}
+
+// Count возвращает число строк таблицы urls.
+func (s *Storage) Count(ctx context.Context) (int, error) {
+	var n int
+	if err := s.pool.QueryRow(ctx, "SELECT count(*) FROM urls").Scan(&n); err != nil {
+		return 0, mapError(err)
+	}
+	return n, nil
+}
+
+// RecordClicks вставляет переходы одним запросом с массивами-параметрами.
+func (s *Storage) RecordClicks(ctx context.Context, clicks []storage.Click) error {
+	if len(clicks) == 0 {
+		return nil
+	}
+	codes := make([]string, 0, len(clicks))
+	times := make([]time.Time, 0, len(clicks))
+	referrers := make([]string, 0, len(clicks))
+	agents := make([]string, 0, len(clicks))
+	ips := make([]string, 0, len(clicks))
+	for _, c := range clicks {
+		codes = append(codes, c.ShortURL)
+		times = append(times, c.At)
+		referrers = append(referrers, c.Referrer)
+		agents = append(agents, c.UserAgent)
+		ips = append(ips, c.IP)
+	}
+	_, err := s.pool.Exec(ctx, `
+		INSERT INTO clicks (short_url, clicked_at, referrer, user_agent, ip)
+		SELECT c.short_url, c.clicked_at, c.referrer, c.user_agent, c.ip
+		FROM unnest($1::text[], $2::timestamptz[], $3::text[], $4::text[], $5::text[])
+			AS c(short_url, clicked_at, referrer, user_agent, ip)
+		WHERE EXISTS (SELECT 1 FROM urls WHERE urls.short_url = c.short_url)
+	`, codes, times, referrers, agents, ips)
+	return mapError(err)
+}
+
+// ClickStats считает статистику по таблице clicks. Переходы, сделанные
+// до создания ссылки, относятся к прежней ссылке с тем же кодом
+// и не учитываются.
+func (s *Storage) ClickStats(ctx context.Context, shortURL string, q storage.StatsQuery) (storage.ClickStats, error) {
+	var stats storage.ClickStats
+	err := s.pool.QueryRow(ctx, `
+		SELECT count(*), count(DISTINCT (c.ip, c.user_agent))
+		FROM clicks c JOIN urls u ON u.short_url = c.short_url
+		WHERE c.short_url = $1 AND c.clicked_at >= u.created_at
+	`, shortURL).Scan(&stats.Total, &stats.Unique)
 	if err != nil {
-		return "", false, err
+		return stats, mapError(err)
 	}
-	return shortURL, isNew, nil
+
+	rows, err := s.pool.Query(ctx, `
+		SELECT date_trunc($2, c.clicked_at, 'UTC') AS bucket, count(*)
+		FROM clicks c JOIN urls u ON u.short_url = c.short_url
+		WHERE c.short_url = $1 AND c.clicked_at >= u.created_at
+			AND c.clicked_at >= $3 AND c.clicked_at < $4
+		GROUP BY bucket ORDER BY bucket
+	`, shortURL, q.Bucket, q.From, q.To)
+	if err != nil {
+		return stats, mapError(err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var b storage.ClickBucket
+		if err := rows.Scan(&b.Start, &b.Clicks); err != nil {
+			return stats, mapError(err)
+		}
+		b.Start = b.Start.UTC()
+		stats.Series = append(stats.Series, b)
+	}
+	return stats, mapError(rows.Err())
 }
 
-func (s *Storage) BatchSave(items map[string]string) error {
-	tx, err := s.db.Begin()
+// ForEach обходит ссылки серверным курсором в порядке создания, выбирая
+// их порциями по cursorFetchSize. Обход идёт в одной транзакции REPEATABLE
+// READ, поэтому видит согласованный снимок таблицы.
+func (s *Storage) ForEach(ctx context.Context, fn func(storage.URL) error) error {
+	tx, err := s.pool.BeginTx(ctx, pgx.TxOptions{IsoLevel: pgx.RepeatableRead, AccessMode: pgx.ReadOnly})
 	if err != nil {
-		return err
+		return mapError(err)
 	}
-	defer tx.Rollback()
+	defer tx.Rollback(ctx)
 
-	stmt, err := tx.Prepare("INSERT INTO urls (short_url, original_url) VALUES ($1, $2)")
+	_, err = tx.Exec(ctx, `
+		DECLARE urls_export NO SCROLL CURSOR FOR
+		SELECT short_url, original_url, user_id, expires_at, is_deleted, created_at
+		FROM urls ORDER BY id
+	`)
 	if err != nil {
-		return err
+		return mapError(err)
 	}
-	defer stmt.Close()
 
-	for key, value := range items {
-		_, err = stmt.Exec(key, value)
+	for {
+		rows, err := tx.Query(ctx, fmt.Sprintf("FETCH %d FROM urls_export", cursorFetchSize))
 		if err != nil {
-			return err
+			return mapError(err)
+		}
+		var page []storage.URL
+		for rows.Next() {
+			var u storage.URL
+			var userID *string
+			var expiresAt *time.Time
+			if err := rows.Scan(&u.ShortURL, &u.OriginalURL, &userID, &expiresAt, &u.Deleted, &u.CreatedAt); err != nil {
+				rows.Close()
+				return mapError(err)
+			}
+			if userID != nil {
+				u.UserID = *userID
+			}
+			if expiresAt != nil {
+				u.ExpiresAt = *expiresAt
+			}
+			page = append(page, u)
+		}
+		if err := rows.Err(); err != nil {
+			return mapError(err)
+		}
+		if len(page) == 0 {
+			return nil
+		}
+
+		for _, u := range page {
+			if err := fn(u); err != nil {
+				return err
+			}
 		}
 	}
+}
 
-	return tx.Commit()
+// NextSequence возвращает следующий номер из последовательности short_code_seq,
+// общей для всех экземпляров сервиса.
+func (s *Storage) NextSequence(ctx context.Context) (uint64, error) {
+	var n int64
+	if err := s.pool.QueryRow(ctx, "SELECT nextval('short_code_seq')").Scan(&n); err != nil {
+		return 0, mapError(err)
+	}
+	return uint64(n), nil
 }
 
 func (s *Storage) Close() error {
-	return s.db.Close()
+	s.pool.Close()
+	return nil
 }
 
 func (s *Storage) Ping(ctx context.Context) error {
-	return s.db.PingContext(ctx)
+	return mapError(s.pool.Ping(ctx))
 }
 
-func (s *Storage) GetByOriginalURL(originalURL string) (string, bool) {
+func (s *Storage) GetByOriginalURL(ctx context.Context, originalURL string) (string, error) {
 	var shortURL string
-	err := s.db.QueryRow("SELECT short_url FROM urls WHERE original_url = $1", originalURL).Scan(&shortURL)
-	if err == sql.ErrNoRows {
-		return "", false
-	}
+	err := s.pool.QueryRow(ctx, `
+		SELECT short_url FROM urls
+		WHERE original_url = $1 AND NOT is_deleted AND (expires_at IS NULL OR expires_at > now())
+	`, originalURL).Scan(&shortURL)
 	if err != nil {
-		return "", false
+		return "", mapError(err)
+	}
+	return shortURL, nil
+}
+
+// mapError переводит ошибки Postgres в ошибки пакета storage. Ошибки
+// соединения и таймауты оборачиваются в storage.ErrUnavailable, отмена
+// запроса клиентом возвращается как есть.
+func mapError(err error) error {
+	if err == nil {
+		return nil
+	}
+	if errors.Is(err, pgx.ErrNoRows) {
+		return storage.ErrNotFound
+	}
+
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) {
+		switch {
+		case pgErr.Code == pgerrcode.UniqueViolation && pgErr.ConstraintName == shortURLConstraint:
+			return storage.ErrCodeTaken
+		case pgErr.Code == pgerrcode.ReadOnlySQLTransaction:
+			return fmt.Errorf("%w: %w", storage.ErrReadOnly, err)
+		case pgerrcode.IsConnectionException(pgErr.Code),
+			pgerrcode.IsInsufficientResources(pgErr.Code),
+			pgErr.Code == pgerrcode.AdminShutdown,
+			pgErr.Code == pgerrcode.CrashShutdown,
+			pgErr.Code == pgerrcode.CannotConnectNow:
+			return fmt.Errorf("%w: %w", storage.ErrUnavailable, err)
+		}
+		return err
+	}
+	if errors.Is(err, context.Canceled) {
+		return err
+	}
+
+	var connectErr *pgconn.ConnectError
+	var netErr net.Error
+	if errors.As(err, &connectErr) || errors.As(err, &netErr) || pgconn.Timeout(err) ||
+		errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return fmt.Errorf("%w: %w", storage.ErrUnavailable, err)
+	}
+	return err
+}
+
+// nullString превращает пустую строку в NULL.
+func nullString(s string) *string {
+	if s == "" {
+		return nil
+	}
+	return &s
+}
+
+// nullTime превращает нулевое время в NULL.
+func nullTime(t time.Time) *time.Time {
+	if t.IsZero() {
+		return nil
 	}
-	return shortURL, true
+	return &t
 }
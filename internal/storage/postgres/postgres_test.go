@@ -0,0 +1,46 @@
+package postgres
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"testing"
+
+	"github.com/jackc/pgerrcode"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/vvityuk/shortener/internal/storage"
+)
+
+func TestMapError(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want error
+	}{
+		{"no rows", pgx.ErrNoRows, storage.ErrNotFound},
+		{"short code taken", &pgconn.PgError{Code: pgerrcode.UniqueViolation, ConstraintName: shortURLConstraint}, storage.ErrCodeTaken},
+		{"read-only", &pgconn.PgError{Code: pgerrcode.ReadOnlySQLTransaction}, storage.ErrReadOnly},
+		{"connection failure", &pgconn.PgError{Code: pgerrcode.ConnectionFailure}, storage.ErrUnavailable},
+		{"server shutdown", &pgconn.PgError{Code: pgerrcode.AdminShutdown}, storage.ErrUnavailable},
+		{"connection closed", fmt.Errorf("read: %w", io.ErrUnexpectedEOF), storage.ErrUnavailable},
+		{"timeout", context.DeadlineExceeded, storage.ErrUnavailable},
+		{"canceled", context.Canceled, context.Canceled},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := mapError(tt.err); !errors.Is(err, tt.want) {
+				t.Errorf("Expected %v, got %v", tt.want, err)
+			}
+		})
+	}
+
+	other := &pgconn.PgError{Code: pgerrcode.UniqueViolation, ConstraintName: "urls_original_url_live_key"}
+	if err := mapError(other); errors.Is(err, storage.ErrCodeTaken) || errors.Is(err, storage.ErrUnavailable) {
+		t.Errorf("Expected other violations to pass through, got %v", err)
+	}
+	if err := mapError(context.Canceled); errors.Is(err, storage.ErrUnavailable) {
+		t.Error("Expected cancellation not to be reported as unavailability")
+	}
+}
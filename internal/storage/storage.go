@@ -0,0 +1,128 @@
+// Package storage содержит общие для всех хранилищ ссылок определения.
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+var (
+	// ErrCodeTaken возвращается при попытке сохранить ссылку под коротким кодом,
+	// который уже занят другим URL.
+	ErrCodeTaken = errors.New("short code already taken")
+	// ErrNotFound — ссылки с таким кодом или URL нет.
+	ErrNotFound = errors.New("short URL not found")
+	// ErrConflict — исходный URL уже сокращён, подробности в ConflictError.
+	ErrConflict = errors.New("URL already shortened")
+	// ErrGone — ссылка истекла или удалена владельцем.
+	ErrGone = errors.New("short URL is gone")
+	// ErrUnavailable — хранилище временно недоступно, запрос можно повторить.
+	ErrUnavailable = errors.New("storage unavailable")
+	// ErrReadOnly — хранилище открыто только для чтения.
+	ErrReadOnly = errors.New("storage is read-only")
+)
+
+// ConflictError возвращается при сохранении уже сокращённого URL
+// и содержит код существующей ссылки. errors.Is(err, ErrConflict) для неё истинно.
+type ConflictError struct {
+	ShortURL string
+}
+
+func (e *ConflictError) Error() string {
+	return fmt.Sprintf("%v as %q", ErrConflict, e.ShortURL)
+}
+
+func (e *ConflictError) Unwrap() error {
+	return ErrConflict
+}
+
+// URL — сохранённая короткая ссылка.
+type URL struct {
+	ShortURL    string
+	OriginalURL string
+	// UserID — идентификатор создавшего ссылку пользователя, может быть пустым.
+	UserID string
+	// ExpiresAt — момент, после которого ссылка перестаёт работать.
+	// Нулевое значение означает бессрочную ссылку.
+	ExpiresAt time.Time
+	// Deleted — ссылка удалена владельцем.
+	Deleted bool
+	// CreatedAt — момент создания ссылки. Хранилище проставляет текущее
+	// время, если значение нулевое.
+	CreatedAt time.Time
+}
+
+// SaveResult — результат сохранения одной ссылки пакета.
+type SaveResult struct {
+	// ShortURL — код, под которым доступен URL.
+	ShortURL string
+	// Existing — URL уже был сокращён раньше (в том числе ранее в этом же
+	// пакете), и вместо новой ссылки возвращён код существующей.
+	Existing bool
+}
+
+// DeleteRequest — запрос пользователя на удаление его ссылки.
+type DeleteRequest struct {
+	UserID   string
+	ShortURL string
+}
+
+// Expired сообщает, истёк ли срок действия ссылки к моменту now.
+func (u URL) Expired(now time.Time) bool {
+	return !u.ExpiresAt.IsZero() && !now.Before(u.ExpiresAt)
+}
+
+// Gone сообщает, что ссылка больше не работает: истекла или удалена.
+func (u URL) Gone(now time.Time) bool {
+	return u.Deleted || u.Expired(now)
+}
+
+// Click — переход по короткой ссылке.
+type Click struct {
+	ShortURL  string
+	At        time.Time
+	Referrer  string
+	UserAgent string
+	// IP — адрес посетителя с обнулёнными младшими битами.
+	IP string
+}
+
+// Интервалы группировки переходов.
+const (
+	BucketHour = "hour"
+	BucketDay  = "day"
+)
+
+// StatsQuery — параметры статистики переходов: ряд строится по интервалам
+// Bucket на промежутке [From, To).
+type StatsQuery struct {
+	Bucket string
+	From   time.Time
+	To     time.Time
+}
+
+// ClickStats — статистика переходов по ссылке. Total и Unique считаются
+// за всё время, Series — только за запрошенный промежуток.
+type ClickStats struct {
+	Total int
+	// Unique — число разных посетителей: пар анонимизированного IP
+	// и User-Agent. Хранилища в памяти и в файле считают большие
+	// значения приближённо.
+	Unique int
+	Series []ClickBucket
+}
+
+// ClickBucket — число переходов за интервал, начинающийся в Start (UTC).
+type ClickBucket struct {
+	Start  time.Time
+	Clicks int
+}
+
+// BucketStart возвращает начало интервала bucket, содержащего t, в UTC.
+func BucketStart(t time.Time, bucket string) time.Time {
+	if bucket == BucketDay {
+		return t.UTC().Truncate(24 * time.Hour)
+	}
+	return t.UTC().Truncate(time.Hour)
+}